@@ -0,0 +1,43 @@
+package kcp2k
+
+import "time"
+
+// Clock is the time source for pings, timeouts, deadlines and rate limits, see WithClock.
+// kcp-go's own retransmission timers always run on the real clock
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the part of *time.Timer kcp2k uses. C returns nil for AfterFunc timers
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (r realTimer) C() <-chan time.Time        { return r.t.C }
+func (r realTimer) Stop() bool                 { return r.t.Stop() }
+func (r realTimer) Reset(d time.Duration) bool { return r.t.Reset(d) }
+
+// deadlineTimer returns a timer channel for an absolute deadline on clock, nil if there is none
+func deadlineTimer(clock Clock, deadline time.Time) (Timer, <-chan time.Time) {
+	if deadline.IsZero() {
+		return nil, nil
+	}
+	t := clock.NewTimer(deadline.Sub(clock.Now()))
+	return t, t.C()
+}
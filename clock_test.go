@@ -0,0 +1,251 @@
+package kcp2k_test
+
+import (
+	"context"
+	"github.com/0990/kcp2k-go"
+	"github.com/0990/kcp2k-go/pkg/fakeclock"
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"github.com/pkg/errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The fakeclock tests live outside the package, fakeclock imports kcp2k
+
+// pair accepts a session on a listener running on fc, the client runs on the real clock.
+// laddr is the listener's address, cconn the client's conn
+func pair(t *testing.T, fc *fakeclock.Clock, opts ...kcp2k.Option) (n *netsim.Network, s *kcp2k.Session, cconn *netsim.Conn, laddr net.Addr) {
+	t.Helper()
+	n = netsim.New(1)
+	lconn, _ := n.Listen("")
+	cconn, _ = n.Listen("")
+	t.Cleanup(func() { lconn.Close(); cconn.Close() })
+
+	l, err := kcp2k.ServeConn(lconn, append([]kcp2k.Option{kcp2k.WithClock(fc)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	c, err := kcp2k.DialConn(cconn, lconn.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	s, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, s, cconn, lconn.LocalAddr()
+}
+
+// readErr returns the error that ends s, Read blocks on the fake clock's deadlines so it has none
+func readErr(s *kcp2k.Session) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		buf := make([]byte, kcp2k.ReliableMaxMessageSize)
+		for {
+			if _, _, err := s.Read(buf); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	return errs
+}
+
+// advanceUntil advances fc a step at a time, each time the session's ping loop waits on it,
+// until done delivers the error that ended the session
+func advanceUntil(t *testing.T, fc *fakeclock.Clock, step time.Duration, done <-chan error) error {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		select {
+		case err := <-done:
+			return err
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session still alive at %s", fc.Now())
+		}
+		if fc.Timers() > 0 {
+			fc.Advance(step)
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestPingTimeoutOnFakeClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	fc := fakeclock.New(start)
+	n, s, cconn, laddr := pair(t, fc, kcp2k.WithPingInterval(time.Second), kcp2k.WithPingTimeout(5*time.Second))
+	// the client goes silent
+	n.SetLink(cconn.LocalAddr(), laddr, netsim.Link{Loss: 1})
+
+	err := advanceUntil(t, fc, time.Second, readErr(s))
+	var derr *kcp2k.DisconnectError
+	if !errors.As(err, &derr) || derr.Code != kcp2k.Timeout || strings.Contains(err.Error(), "idle") {
+		t.Fatalf("Read returned %v, want a ping timeout", err)
+	}
+	if elapsed := fc.Now().Sub(start); elapsed <= 5*time.Second || elapsed > 7*time.Second {
+		t.Fatalf("timed out after %s, want 5s and at most one more ping interval", elapsed)
+	}
+}
+
+func TestIdleTimeoutOnFakeClock(t *testing.T) {
+	start := time.Unix(0, 0)
+	fc := fakeclock.New(start)
+	_, s, _, _ := pair(t, fc, kcp2k.WithPingInterval(time.Second), kcp2k.WithPingTimeout(time.Hour),
+		kcp2k.WithIdleTimeout(3*time.Second))
+
+	err := advanceUntil(t, fc, time.Second, readErr(s))
+	var derr *kcp2k.DisconnectError
+	if !errors.As(err, &derr) || derr.Code != kcp2k.Timeout || !strings.Contains(err.Error(), "idle") {
+		t.Fatalf("Read returned %v, want an idle timeout", err)
+	}
+	if elapsed := fc.Now().Sub(start); elapsed <= 3*time.Second || elapsed > 5*time.Second {
+		t.Fatalf("idle timeout after %s, want 3s and at most one more ping interval", elapsed)
+	}
+}
+
+func TestHandshakeTimeoutOnFakeClock(t *testing.T) {
+	fc := fakeclock.New(time.Unix(0, 0))
+	// a server that never answers
+	silent, conn := netsim.Pipe(1, netsim.Link{}, netsim.Link{})
+	defer silent.Close()
+	defer conn.Close()
+
+	reasons := make(chan kcp2k.HandshakeFailReason, 1)
+	dialled := make(chan error, 1)
+	go func() {
+		_, err := kcp2k.DialConn(conn, silent.LocalAddr(), kcp2k.WithClock(fc), kcp2k.WithHandshakeTimeout(time.Minute), kcp2k.WithLogger(slog.New(&warnings{})),
+			kcp2k.WithOnHandshakeFailed(func(addr net.Addr, reason kcp2k.HandshakeFailReason) { reasons <- reason }))
+		dialled <- err
+	}()
+
+	fc.BlockUntil(1)
+	fc.Advance(time.Minute - time.Millisecond)
+	select {
+	case err := <-dialled:
+		t.Fatalf("DialConn returned %v before the handshake timeout", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	fc.Advance(time.Millisecond)
+
+	select {
+	case err := <-dialled:
+		if !errors.Is(err, kcp2k.ErrHandshake) || !errors.Is(err, kcp2k.ErrTimeout) {
+			t.Fatalf("DialConn returned %v, want a handshake timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DialConn still blocked after the handshake timeout")
+	}
+	if reason := <-reasons; reason != kcp2k.HandshakeTimeout {
+		t.Fatalf("OnHandshakeFailed got %s, want timeout", reason)
+	}
+}
+
+func TestIPFilterBanExpiresOnClock(t *testing.T) {
+	fc := fakeclock.New(time.Unix(0, 0))
+	f := kcp2k.NewIPFilter()
+	f.SetClock(fc)
+	addr := netip.MustParseAddr("198.51.100.7")
+	peer := netip.AddrPortFrom(addr, 1)
+
+	f.Ban(addr, time.Minute)
+	if f.Admit(peer) {
+		t.Fatal("banned address admitted")
+	}
+	if until := f.Banned()[addr]; !until.Equal(time.Unix(60, 0)) {
+		t.Fatalf("ban expires at %s, want a minute on the fake clock", until)
+	}
+	fc.Advance(time.Minute)
+	if !f.Admit(peer) {
+		t.Fatal("address still rejected after the ban expired")
+	}
+	if len(f.Banned()) != 0 {
+		t.Fatal("expired ban not pruned")
+	}
+}
+
+// warnings records the messages of warnings and their suppressed counts
+type warnings struct {
+	mu         sync.Mutex
+	msgs       []string
+	suppressed []int64
+}
+
+func (w *warnings) Enabled(context.Context, slog.Level) bool { return true }
+func (w *warnings) WithAttrs([]slog.Attr) slog.Handler       { return w }
+func (w *warnings) WithGroup(string) slog.Handler            { return w }
+
+func (w *warnings) Handle(_ context.Context, r slog.Record) error {
+	if r.Level != slog.LevelWarn {
+		return nil
+	}
+	var suppressed int64
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "suppressed" {
+			suppressed = a.Value.Int64()
+		}
+		return true
+	})
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.msgs = append(w.msgs, r.Message)
+	w.suppressed = append(w.suppressed, suppressed)
+	return nil
+}
+
+func (w *warnings) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.msgs)
+}
+
+func TestLogRateLimitOnClock(t *testing.T) {
+	fc := fakeclock.New(time.Unix(0, 0))
+	w := &warnings{}
+	_, _, cconn, laddr := pair(t, fc, kcp2k.WithLogger(slog.New(w)), kcp2k.WithLogRateLimit(2, time.Minute),
+		kcp2k.WithPingInterval(time.Hour), kcp2k.WithPingTimeout(time.Hour))
+
+	// datagrams from the client's address with a wrong cookie
+	badCookie := []byte{byte(kcp2k.Unreliable), 0xde, 0xad, 0xbe, 0xef, 'x'}
+	send := func(count int) {
+		for i := 0; i < count; i++ {
+			if _, err := cconn.WriteTo(badCookie, laddr); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitWarnings := func(want int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for w.count() < want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d warnings, want %d", w.count(), want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	send(5)
+	waitWarnings(2)
+	time.Sleep(50 * time.Millisecond)
+	if n := w.count(); n != 2 {
+		t.Fatalf("%d warnings within a minute, the limit is 2", n)
+	}
+
+	fc.Advance(time.Minute)
+	send(1)
+	waitWarnings(3)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.msgs[2] != "invalid cookie" || w.suppressed[2] != 3 {
+		t.Fatalf("warning %q with %d suppressed, want invalid cookie with 3", w.msgs[2], w.suppressed[2])
+	}
+}
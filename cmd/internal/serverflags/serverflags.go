@@ -0,0 +1,83 @@
+// Package serverflags holds the listener flags kcp2k-echo and kcp2k-relay share
+package serverflags
+
+import (
+	"flag"
+	"fmt"
+	"github.com/0990/kcp2k-go"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+type Flags struct {
+	addr             *string
+	logLevel         *string
+	maxSessions      *int
+	maxSessionsPerIP *int
+	maxPending       *int
+	pingInterval     *time.Duration
+	pingTimeout      *time.Duration
+	idleTimeout      *time.Duration
+	handshakeTimeout *time.Duration
+	resumeGrace      *time.Duration
+	metricsAddr      *string
+}
+
+// Register adds the listener flags to the command line, listening on defaultAddr unless -addr is set
+func Register(defaultAddr string) *Flags {
+	return RegisterSet(flag.CommandLine, defaultAddr)
+}
+
+// RegisterSet is Register for the flags of fs
+func RegisterSet(fs *flag.FlagSet, defaultAddr string) *Flags {
+	return &Flags{
+		addr:             fs.String("addr", defaultAddr, "UDP address to listen on"),
+		logLevel:         fs.String("log", "info", "log level: debug, info, warn or error"),
+		maxSessions:      fs.Int("max-sessions", 0, "cap on sessions, 0 is unlimited"),
+		maxSessionsPerIP: fs.Int("max-sessions-per-ip", 0, "cap on sessions per IP, 0 is unlimited"),
+		maxPending:       fs.Int("max-pending", 0, "cap on sessions still in the handshake, 0 is unlimited"),
+		pingInterval:     fs.Duration("ping-interval", time.Second, "how often sessions ping their peer"),
+		pingTimeout:      fs.Duration("ping-timeout", kcp2k.PingTimeout, "disconnect sessions that receive nothing for this long"),
+		idleTimeout:      fs.Duration("idle-timeout", 0, "disconnect sessions that receive no messages for this long, 0 disables"),
+		handshakeTimeout: fs.Duration("handshake-timeout", kcp2k.HandshakeTimeoutDefault, "handshake timeout"),
+		resumeGrace:      fs.Duration("resume", 0, "keep timed out sessions this long for clients to resume, 0 disables"),
+		metricsAddr:      fs.String("metrics", "", "serve Prometheus metrics over HTTP on this address, such as :9100"),
+	}
+}
+
+// Listen creates the listener the flags describe, after they were parsed. opts are applied last
+func (f *Flags) Listen(opts ...kcp2k.Option) (*kcp2k.Listener, *slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*f.logLevel)); err != nil {
+		return nil, nil, fmt.Errorf("invalid -log: %w", err)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	opts = append([]kcp2k.Option{
+		kcp2k.WithLogger(logger),
+		kcp2k.WithMaxSessions(*f.maxSessions),
+		kcp2k.WithMaxSessionsPerIP(*f.maxSessionsPerIP),
+		kcp2k.WithMaxPendingHandshakes(*f.maxPending),
+		kcp2k.WithPingInterval(*f.pingInterval),
+		kcp2k.WithPingTimeout(*f.pingTimeout),
+		kcp2k.WithIdleTimeout(*f.idleTimeout),
+		kcp2k.WithHandshakeTimeout(*f.handshakeTimeout),
+		kcp2k.WithResumption(*f.resumeGrace),
+	}, opts...)
+	l, err := kcp2k.ListenWithOptions(*f.addr, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if *f.metricsAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(*f.metricsAddr, l.MetricsHandler()); err != nil {
+				logger.Error("metrics server stopped", "error", err)
+			}
+		}()
+	}
+	logger.Info("listening", "addr", l.Addr().String())
+	return l, logger, nil
+}
@@ -0,0 +1,73 @@
+package serverflags
+
+import (
+	"flag"
+	"github.com/0990/kcp2k-go"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parse(t *testing.T, args ...string) (*Flags, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	f := RegisterSet(fs, "127.0.0.1:0")
+	return f, fs.Parse(args)
+}
+
+func TestParseAndListen(t *testing.T) {
+	f, err := parse(t, "-addr", "127.0.0.1:0", "-log", "error", "-max-sessions", "10", "-max-sessions-per-ip", "2",
+		"-max-pending", "5", "-ping-interval", "200ms", "-ping-timeout", "2s", "-idle-timeout", "1m",
+		"-handshake-timeout", "3s", "-resume", "10s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *f.maxSessions != 10 || *f.maxSessionsPerIP != 2 || *f.maxPending != 5 || *f.pingInterval != 200*time.Millisecond ||
+		*f.pingTimeout != 2*time.Second || *f.idleTimeout != time.Minute || *f.handshakeTimeout != 3*time.Second ||
+		*f.resumeGrace != 10*time.Second {
+		t.Fatal("a flag was parsed wrong")
+	}
+
+	l, _, err := f.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	s, err := kcp2k.DialWithOptions(l.Addr().String(), kcp2k.WithResumption(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.ResumeToken() == nil {
+		t.Fatal("-resume didn't enable resumption")
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	f, err := parse(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *f.addr != "127.0.0.1:0" || *f.logLevel != "info" || *f.pingTimeout != kcp2k.PingTimeout ||
+		*f.handshakeTimeout != kcp2k.HandshakeTimeoutDefault || *f.resumeGrace != 0 || *f.metricsAddr != "" {
+		t.Fatal("a default is wrong")
+	}
+}
+
+func TestInvalidFlags(t *testing.T) {
+	if _, err := parse(t, "-ping-interval", "often"); err == nil {
+		t.Error("parsed an invalid duration")
+	}
+	if _, err := parse(t, "-max-sessions", "many"); err == nil {
+		t.Error("parsed an invalid number")
+	}
+	f, err := parse(t, "-log", "loud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := f.Listen(); err == nil || !strings.Contains(err.Error(), "-log") {
+		t.Errorf("Listen with an invalid -log returned %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+// kcp2k-bench loads a kcp2k server with simulated clients and reports handshake success,
+// echo latency, throughput and disconnect reasons. Latency and echoed counts need a server
+// that echoes every message back on its channel; without an address it benchmarks an
+// in-process echo Listener
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/0990/kcp2k-go"
+	"log/slog"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	clients          = flag.Int("clients", 100, "number of simulated clients")
+	rampUp           = flag.Duration("ramp", 5*time.Second, "spread the clients' dials over this long")
+	duration         = flag.Duration("duration", 30*time.Second, "keep sending this long once every client dialled")
+	size             = flag.Int("size", 64, "message size in bytes, at least 8")
+	rate             = flag.Float64("rate", 10, "messages per second per client")
+	reliableRatio    = flag.Float64("reliable", 0.5, "fraction of the messages sent on the reliable channel")
+	drain            = flag.Duration("drain", time.Second, "wait this long for echoes after the last send")
+	interval         = flag.Duration("interval", time.Second, "print progress this often, 0 disables")
+	handshakeTimeout = flag.Duration("handshake-timeout", 5*time.Second, "handshake timeout")
+	logLevel         = flag.String("log", "error", "log level: debug, info, warn or error")
+)
+
+// bench is shared by every client
+type bench struct {
+	opts []kcp2k.Option
+
+	handshakes   recorder // dial durations of successful handshakes
+	dialFailures counter  // by HandshakeFailReason
+	disconnects  counter  // by ErrorCode, or the error for anything else
+	latency      [2]recorder
+	sent         [2]traffic
+	recv         [2]traffic
+	active       atomic.Int64
+
+	stop chan struct{} // closed when clients stop sending
+	quit chan struct{} // closed when clients close their sessions
+}
+
+type traffic struct {
+	messages atomic.Uint64
+	bytes    atomic.Uint64
+}
+
+func (t *traffic) add(n int) {
+	t.messages.Add(1)
+	t.bytes.Add(uint64(n))
+}
+
+type trafficCount struct {
+	messages, bytes uint64
+}
+
+func (t *traffic) load() trafficCount {
+	return trafficCount{t.messages.Load(), t.bytes.Load()}
+}
+
+// sample is the traffic per channel so far
+type sample struct {
+	sent, recv [2]trafficCount
+}
+
+func (b *bench) sample() sample {
+	var s sample
+	for i := range s.sent {
+		s.sent[i], s.recv[i] = b.sent[i].load(), b.recv[i].load()
+	}
+	return s
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: kcp2k-bench [flags] [host:port]\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 || *clients <= 0 || *rate <= 0 || *reliableRatio < 0 || *reliableRatio > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	maxSize := kcp2k.UnreliableMaxMessageSize
+	if *reliableRatio == 1 {
+		maxSize = kcp2k.ReliableMaxMessageSize
+	}
+	if *size < 8 || *size > maxSize {
+		fmt.Fprintf(os.Stderr, "-size must be within [8, %d]\n", maxSize)
+		os.Exit(2)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -log:", err)
+		os.Exit(2)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	addr := flag.Arg(0)
+	if addr == "" {
+		l, err := kcp2k.ListenWithOptions("127.0.0.1:0", kcp2k.WithLogger(logger))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "listen:", err)
+			os.Exit(1)
+		}
+		defer l.Close()
+		go echo(l)
+		addr = l.Addr().String()
+		fmt.Printf("benchmarking the in-process echo listener on %s\n", addr)
+	}
+
+	b := &bench{
+		stop: make(chan struct{}),
+		quit: make(chan struct{}),
+	}
+	b.opts = []kcp2k.Option{
+		kcp2k.WithLogger(logger),
+		kcp2k.WithHandshakeTimeout(*handshakeTimeout),
+		kcp2k.WithOnHandshakeFailed(func(_ net.Addr, reason kcp2k.HandshakeFailReason) {
+			b.dialFailures.add(reason.String())
+		}),
+	}
+
+	start := time.Now()
+	if *interval > 0 {
+		go b.progress(start)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < *clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			time.Sleep(time.Duration(i) * *rampUp / time.Duration(*clients))
+			b.client(addr)
+		}(i)
+	}
+
+	// rates cover the measurement phase only, once every client dialled
+	time.Sleep(*rampUp)
+	measureStart, from := time.Now(), b.sample()
+	time.Sleep(*duration)
+	close(b.stop)
+	measured, to := time.Since(measureStart), b.sample()
+	time.Sleep(*drain)
+	close(b.quit)
+	wg.Wait()
+
+	b.report(measured, from, to)
+}
+
+// client dials addr, then sends at the configured rate until stop and reads echoes until quit
+func (b *bench) client(addr string) {
+	dialStart := time.Now()
+	sess, err := kcp2k.DialWithOptions(addr, b.opts...)
+	if err != nil {
+		if !errors.Is(err, kcp2k.ErrHandshake) {
+			// DNS or socket errors don't reach OnHandshakeFailed
+			b.dialFailures.add(err.Error())
+		}
+		return
+	}
+	b.handshakes.add(time.Since(dialStart))
+	b.active.Add(1)
+	defer b.active.Add(-1)
+
+	var closed atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.readLoop(sess, &closed)
+	}()
+
+	b.sendLoop(sess)
+
+	select {
+	case <-b.quit:
+	case <-done:
+	}
+	closed.Store(true)
+	sess.Close()
+	<-done
+}
+
+func (b *bench) sendLoop(sess *kcp2k.Session) {
+	// 随机起始相位，避免所有客户端同时发送
+	period := time.Duration(float64(time.Second) / *rate)
+	if period <= 0 {
+		period = time.Nanosecond
+	}
+	time.Sleep(time.Duration(rand.Int63n(int64(period))))
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	msg := make([]byte, *size)
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+
+		channel := kcp2k.Unreliable
+		if rand.Float64() < *reliableRatio {
+			channel = kcp2k.Reliable
+		}
+		binary.BigEndian.PutUint64(msg, uint64(time.Now().UnixNano()))
+		if _, err := sess.Send(msg, channel); err != nil {
+			// readLoop records why
+			return
+		}
+		b.sent[slot(channel)].add(len(msg))
+	}
+}
+
+func (b *bench) readLoop(sess *kcp2k.Session, closed *atomic.Bool) {
+	buf := make([]byte, kcp2k.ReliableMaxMessageSize)
+	for {
+		n, channel, err := sess.Read(buf)
+		if err != nil {
+			if !closed.Load() {
+				b.disconnects.add(disconnectReason(err))
+			}
+			return
+		}
+		b.recv[slot(channel)].add(n)
+		if n >= 8 {
+			sent := time.Unix(0, int64(binary.BigEndian.Uint64(buf)))
+			b.latency[slot(channel)].add(time.Since(sent))
+		}
+	}
+}
+
+func disconnectReason(err error) string {
+	var derr *kcp2k.DisconnectError
+	if errors.As(err, &derr) {
+		return derr.Code.String()
+	}
+	return err.Error()
+}
+
+func (b *bench) progress(start time.Time) {
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.quit:
+			return
+		case <-ticker.C:
+		}
+		fmt.Fprintf(os.Stderr, "%6s  sessions %d  sent %d  recv %d  dial failures %d  disconnects %d\n",
+			time.Since(start).Round(time.Second), b.active.Load(),
+			b.sent[0].messages.Load()+b.sent[1].messages.Load(),
+			b.recv[0].messages.Load()+b.recv[1].messages.Load(),
+			b.dialFailures.total(), b.disconnects.total())
+	}
+}
+
+// echo sends every message back on the channel it came in on
+func echo(l *kcp2k.Listener) {
+	for {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer s.Close()
+			buf := make([]byte, kcp2k.ReliableMaxMessageSize)
+			for {
+				n, channel, err := s.Read(buf)
+				if err != nil {
+					return
+				}
+				if _, err = s.Send(buf[:n], channel); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func slot(channel kcp2k.Channel) int {
+	if channel == kcp2k.Unreliable {
+		return 1
+	}
+	return 0
+}
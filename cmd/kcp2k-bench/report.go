@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// recorder keeps every sample for exact percentiles
+type recorder struct {
+	mu      sync.Mutex
+	samples []time.Duration
+}
+
+func (r *recorder) add(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples = append(r.samples, d)
+}
+
+// percentiles sorts the samples and returns them at each of ps, in [0, 100]
+func (r *recorder) percentiles(ps ...float64) []time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]time.Duration, len(ps))
+	if len(r.samples) == 0 {
+		return out
+	}
+	sort.Slice(r.samples, func(i, j int) bool { return r.samples[i] < r.samples[j] })
+	for i, p := range ps {
+		idx := int(p / 100 * float64(len(r.samples)-1))
+		out[i] = r.samples[idx]
+	}
+	return out
+}
+
+func (r *recorder) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.samples)
+}
+
+// counter counts occurrences by key
+type counter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (c *counter) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.counts[key]++
+}
+
+func (c *counter) total() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for _, count := range c.counts {
+		n += count
+	}
+	return n
+}
+
+// print writes one line per key, most frequent first
+func (c *counter) print(indent string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := make([]string, 0, len(c.counts))
+	for k := range c.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if c.counts[keys[i]] == c.counts[keys[j]] {
+			return keys[i] < keys[j]
+		}
+		return c.counts[keys[i]] > c.counts[keys[j]]
+	})
+	for _, k := range keys {
+		fmt.Printf("%s%-24s %d\n", indent, k, c.counts[k])
+	}
+}
+
+// report prints the results. Counts cover the whole run, rates the measurement phase: the
+// samples from and to, taken elapsed apart
+func (b *bench) report(elapsed time.Duration, from, to sample) {
+	dialled := b.handshakes.len()
+	failed := b.dialFailures.total()
+	fmt.Printf("\nhandshakes: %d/%d succeeded (%.1f%%)\n", dialled, dialled+failed, ratio(dialled, dialled+failed))
+	if dialled > 0 {
+		p := b.handshakes.percentiles(50, 99, 100)
+		fmt.Printf("  dial time p50 %s  p99 %s  max %s\n", round(p[0]), round(p[1]), round(p[2]))
+	}
+	if failed > 0 {
+		fmt.Println("  failures:")
+		b.dialFailures.print("    ")
+	}
+
+	for i, name := range []string{"reliable", "unreliable"} {
+		sent, recv := &b.sent[i], &b.recv[i]
+		fmt.Printf("\n%s:\n", name)
+		fmt.Printf("  sent %d msgs (%.0f msg/s, %s/s)  echoed %d msgs (%.1f%%, %s/s)\n",
+			sent.messages.Load(), perSecond(from.sent[i].messages, to.sent[i].messages, elapsed),
+			bytes(perSecond(from.sent[i].bytes, to.sent[i].bytes, elapsed)),
+			recv.messages.Load(), ratio(int(recv.messages.Load()), int(sent.messages.Load())),
+			bytes(perSecond(from.recv[i].bytes, to.recv[i].bytes, elapsed)))
+		if b.latency[i].len() > 0 {
+			p := b.latency[i].percentiles(50, 90, 99, 99.9, 100)
+			fmt.Printf("  latency p50 %s  p90 %s  p99 %s  p99.9 %s  max %s\n",
+				round(p[0]), round(p[1]), round(p[2]), round(p[3]), round(p[4]))
+		}
+	}
+
+	fmt.Printf("\ndisconnects: %d\n", b.disconnects.total())
+	b.disconnects.print("  ")
+}
+
+func perSecond(from, to uint64, elapsed time.Duration) float64 {
+	return float64(to-from) / elapsed.Seconds()
+}
+
+func ratio(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	default:
+		return d.Round(time.Microsecond)
+	}
+}
+
+func bytes(n float64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", n/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", n/(1<<10))
+	default:
+		return fmt.Sprintf("%.0fB", n)
+	}
+}
@@ -0,0 +1,256 @@
+// kcp2k-cli dials a kcp2k server, such as a Mirror dedicated server, and sends it the messages
+// typed on stdin. When stdin is not a terminal the lines are run as a script
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/0990/kcp-go"
+	"github.com/0990/kcp2k-go"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const usage = `commands:
+  r <text>              send text on the reliable channel
+  u <text>              send text on the unreliable channel
+  r|u hex <hex>         send hex bytes, spaces are ignored
+  r|u file <path>       send a file's contents
+  r|u text <text>       send text that starts with "hex" or "file"
+  stats                 print RTT and loss stats
+  sleep <duration>      pause a script, such as "sleep 500ms"
+  # comment             ignored, like empty lines
+  help                  print this help
+  quit                  close the session and exit
+`
+
+var (
+	hexOut           = flag.Bool("hex", false, "print received messages as hex")
+	statsInterval    = flag.Duration("stats", 5*time.Second, "print stats this often, 0 disables")
+	linger           = flag.Duration("linger", time.Second, "in a script, wait this long after the last line for replies")
+	handshakeTimeout = flag.Duration("handshake-timeout", 10*time.Second, "handshake timeout")
+	pingTimeout      = flag.Duration("ping-timeout", 10*time.Second, "disconnect after receiving nothing for this long")
+	logLevel         = flag.String("log", "warn", "log level: debug, info, warn or error")
+)
+
+var (
+	out        sync.Mutex       // keeps lines written by the read loop and the commands whole
+	sent, recv [2]atomic.Uint64 // messages by channel, reliable then unreliable
+	quitting   atomic.Bool
+)
+
+func slot(channel kcp2k.Channel) int {
+	if channel == kcp2k.Unreliable {
+		return 1
+	}
+	return 0
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: kcp2k-cli [flags] host:port\n\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\n%s", usage)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid -log:", err)
+		os.Exit(2)
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	sess, err := kcp2k.DialWithOptions(flag.Arg(0),
+		kcp2k.WithLogger(logger),
+		kcp2k.WithHandshakeTimeout(*handshakeTimeout),
+		kcp2k.WithPingTimeout(*pingTimeout))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dial:", err)
+		os.Exit(1)
+	}
+	printf("connected to %s\n", sess.RemoteAddr())
+
+	go readLoop(sess)
+	if *statsInterval > 0 {
+		go func() {
+			for range time.Tick(*statsInterval) {
+				printStats(sess)
+			}
+		}()
+	}
+
+	interactive := isTerminal(os.Stdin)
+	if err := run(sess, interactive); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		quit(sess, 1)
+	}
+	if !interactive {
+		time.Sleep(*linger)
+	}
+	quit(sess, 0)
+}
+
+// run executes the commands read from stdin until quit or EOF. In a script the first failing
+// command stops it, interactively it's only reported
+func run(sess *kcp2k.Session, interactive bool) error {
+	sc := bufio.NewScanner(os.Stdin)
+	sc.Buffer(make([]byte, 64*1024), kcp2k.ReliableMaxMessageSize*2+1024)
+	for line := 1; ; line++ {
+		if interactive {
+			printf("> ")
+		}
+		if !sc.Scan() {
+			return sc.Err()
+		}
+		done, err := execute(sess, sc.Text())
+		if done {
+			return nil
+		}
+		if err != nil {
+			if !interactive {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			printf("error: %v\n", err)
+		}
+	}
+}
+
+// execute runs one command line, done is true for quit
+func execute(sess *kcp2k.Session, line string) (done bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return false, nil
+	}
+
+	cmd, arg, _ := strings.Cut(line, " ")
+	switch cmd {
+	case "r", "u":
+		channel := kcp2k.Reliable
+		if cmd == "u" {
+			channel = kcp2k.Unreliable
+		}
+		payload, err := parsePayload(arg)
+		if err != nil {
+			return false, err
+		}
+		if _, err = sess.Send(payload, channel); err != nil {
+			return false, err
+		}
+		sent[slot(channel)].Add(1)
+		return false, nil
+	case "stats":
+		printStats(sess)
+		return false, nil
+	case "sleep":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return false, err
+		}
+		time.Sleep(d)
+		return false, nil
+	case "help":
+		printf("%s", usage)
+		return false, nil
+	case "quit", "exit":
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown command %q, try help", cmd)
+	}
+}
+
+// parsePayload decodes "hex <hex>", "file <path>", "text <text>" or plain text
+func parsePayload(arg string) ([]byte, error) {
+	kind, rest, _ := strings.Cut(arg, " ")
+	switch kind {
+	case "hex":
+		b, err := hex.DecodeString(strings.Join(strings.Fields(rest), ""))
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex: %w", err)
+		}
+		return b, nil
+	case "file":
+		return os.ReadFile(strings.TrimSpace(rest))
+	case "text":
+		return []byte(rest), nil
+	default:
+		return []byte(arg), nil
+	}
+}
+
+func readLoop(sess *kcp2k.Session) {
+	buf := make([]byte, kcp2k.ReliableMaxMessageSize)
+	for {
+		n, channel, err := sess.Read(buf)
+		if err != nil {
+			if quitting.Load() {
+				return
+			}
+			var derr *kcp2k.DisconnectError
+			if errors.As(err, &derr) {
+				printf("disconnected (%s): %v\n", derr.Code, derr.Err)
+			} else {
+				printf("read: %v\n", err)
+			}
+			quit(sess, 1)
+		}
+		recv[slot(channel)].Add(1)
+		printf("%s %-10s %5dB %s\n", time.Now().Format("15:04:05.000"), channel, n, format(buf[:n]))
+	}
+}
+
+// format prints text quoted and anything else, or everything with -hex, as hex
+func format(b []byte) string {
+	if !*hexOut && utf8.Valid(b) && strings.IndexFunc(string(b), func(r rune) bool {
+		return !unicode.IsPrint(r) && !unicode.IsSpace(r)
+	}) < 0 {
+		return strconv.Quote(string(b))
+	}
+	return hex.EncodeToString(b)
+}
+
+// printStats prints the session's RTT, the messages sent and received on each channel and
+// kcp's retransmission and loss rates, which kcp-go only counts per process
+func printStats(sess *kcp2k.Session) {
+	snmp := kcp.DefaultSnmp.Copy()
+	percent := func(n uint64) float64 {
+		if snmp.OutSegs == 0 {
+			return 0
+		}
+		return float64(n) * 100 / float64(snmp.OutSegs)
+	}
+	printf("rtt %s  sent r=%d u=%d  recv r=%d u=%d  retrans %.1f%%  lost %.1f%%\n",
+		sess.RTT(), sent[0].Load(), sent[1].Load(), recv[0].Load(), recv[1].Load(),
+		percent(snmp.RetransSegs), percent(snmp.LostSegs))
+}
+
+func quit(sess *kcp2k.Session, code int) {
+	quitting.Store(true)
+	sess.Close()
+	os.Exit(code)
+}
+
+func printf(format string, args ...any) {
+	out.Lock()
+	defer out.Unlock()
+	fmt.Printf(format, args...)
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,73 @@
+// kcp2k-echo sends every message a session receives back to it, on the channel it came in on
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/0990/kcp2k-go"
+	"github.com/0990/kcp2k-go/cmd/internal/serverflags"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+var (
+	echoReliable   = flag.Bool("reliable", true, "echo reliable messages")
+	echoUnreliable = flag.Bool("unreliable", true, "echo unreliable messages")
+)
+
+func main() {
+	sf := serverflags.Register(":7777")
+	flag.Parse()
+
+	l, logger, err := sf.Listen()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		l.Close()
+	}()
+
+	for {
+		s, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, kcp2k.ErrClosed) {
+				return
+			}
+			logger.Error("accept", "error", err)
+			os.Exit(1)
+		}
+		go handleEcho(s, logger.With("id", s.ID(), "remote", s.RemoteAddr().String()))
+	}
+}
+
+// handleEcho sends back everything it received on the channels being echoed
+func handleEcho(s *kcp2k.Session, logger *slog.Logger) {
+	logger.Info("session accepted")
+	defer s.Close()
+
+	buf := make([]byte, kcp2k.ReliableMaxMessageSize)
+	for {
+		n, channel, err := s.Read(buf)
+		if err != nil {
+			logger.Info("session closed", "error", err)
+			return
+		}
+		logger.Debug("recv", "channel", channel, "size", n)
+
+		if channel == kcp2k.Reliable && !*echoReliable || channel == kcp2k.Unreliable && !*echoUnreliable {
+			continue
+		}
+		if _, err = s.Send(buf[:n], channel); err != nil {
+			logger.Info("session closed", "error", err)
+			return
+		}
+	}
+}
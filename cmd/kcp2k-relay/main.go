@@ -0,0 +1,155 @@
+// kcp2k-relay bridges kcp2k clients to a TCP backend. Every session gets its own backend
+// connection, its reliable messages are written to it and what the backend writes back is
+// sent to the session as reliable messages. Unreliable messages are dropped
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/0990/kcp2k-go"
+	"github.com/0990/kcp2k-go/cmd/internal/serverflags"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	backend     = flag.String("backend", "", "TCP address of the backend, required")
+	framing     = flag.String("framing", "raw", "raw writes messages to the backend as a plain stream, length prefixes each with its 4-byte big-endian size both ways")
+	dialTimeout = flag.Duration("dial-timeout", 5*time.Second, "backend dial timeout")
+)
+
+func main() {
+	sf := serverflags.Register(":7777")
+	flag.Parse()
+	if *backend == "" || *framing != "raw" && *framing != "length" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	l, logger, err := sf.Listen()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		l.Close()
+	}()
+
+	for {
+		s, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, kcp2k.ErrClosed) {
+				return
+			}
+			logger.Error("accept", "error", err)
+			os.Exit(1)
+		}
+		go relay(s, logger.With("id", s.ID(), "remote", s.RemoteAddr().String()))
+	}
+}
+
+// relay copies between s and a new backend connection until either side closes, then closes both
+func relay(s *kcp2k.Session, logger *slog.Logger) {
+	defer s.Close()
+
+	conn, err := net.DialTimeout("tcp", *backend, *dialTimeout)
+	if err != nil {
+		logger.Warn("backend dial failed", "error", err)
+		return
+	}
+	defer conn.Close()
+	logger.Info("session relayed", "backend", conn.RemoteAddr().String())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := toBackend(s, conn, logger); err != nil {
+			logger.Info("session closed", "error", err)
+		}
+		conn.Close()
+	}()
+
+	if err := fromBackend(conn, s); err != nil {
+		logger.Info("backend closed", "error", err)
+	}
+	s.Close()
+	wg.Wait()
+}
+
+// toBackend returns nil once fromBackend closed the session
+func toBackend(s *kcp2k.Session, conn net.Conn, logger *slog.Logger) error {
+	buf := make([]byte, 4+kcp2k.ReliableMaxMessageSize)
+	for {
+		n, channel, err := s.Read(buf[4:])
+		if err != nil {
+			var derr *kcp2k.DisconnectError
+			if !errors.As(err, &derr) && errors.Is(err, kcp2k.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if channel != kcp2k.Reliable {
+			logger.Debug("unreliable message dropped", "size", n)
+			continue
+		}
+
+		msg := buf[4 : 4+n]
+		if *framing == "length" {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			msg = buf[:4+n]
+		}
+		if _, err = conn.Write(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// fromBackend returns nil once the session ended, and io.EOF when the backend closed conn
+func fromBackend(conn net.Conn, s *kcp2k.Session) error {
+	buf := make([]byte, kcp2k.ReliableMaxMessageSize)
+	for {
+		var n int
+		var err error
+		if *framing == "length" {
+			n, err = readFrame(conn, buf)
+		} else {
+			n, err = conn.Read(buf)
+		}
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if _, err = s.Send(buf[:n], kcp2k.Reliable); err != nil {
+			// toBackend reports why the session ended
+			return nil
+		}
+	}
+}
+
+// readFrame reads one length-prefixed message into buf
+func readFrame(r io.Reader, buf []byte) (int, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > uint32(len(buf)) {
+		return 0, fmt.Errorf("backend message of %d bytes exceeds %d", n, len(buf))
+	}
+	return io.ReadFull(r, buf[:n])
+}
@@ -0,0 +1,366 @@
+package kcp2k
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"github.com/0990/kcp2k-go/pkg/trace"
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The traces in testdata/conformance are built by hand from kcp2k's C# framing and kcp's segment
+// rules, see its README. They are not captures of Mirror's C# kcp2k, those are still needed.
+// listener*.jsonl has the Go side serving and session*.jsonl dialling. The replay plays the peer:
+// "in" records are written to the Go side and "out" records are what it must answer.
+//
+// Answers are compared segment by segment, ACKs included, since kcp may pack segments into
+// datagrams differently. Each must be byte-identical except for two kcp header fields that depend
+// on timing: ts, the sender's clock, and wnd, the receive window left while the application hasn't
+// read yet. Cookies and convs are random, the first time the Go side answers with one it is bound
+// to the recorded value. Pings run on a timer, so the replay sets a ping interval that never fires
+// and makes the Go side send the pings a trace expects
+const conformancePingInterval = time.Hour
+
+// conformanceMessage is one kcp segment of a reliable datagram, or an unreliable datagram
+type conformanceMessage struct {
+	channel Channel
+	cookie  []byte
+	seg     []byte // kcp segment header, reliable only
+	payload []byte // opcode and data of a reliable PUSH
+}
+
+func (m conformanceMessage) isPush() bool {
+	return m.channel == Reliable && m.seg[4] == kcpCmdPush
+}
+
+func (m conformanceMessage) sn() uint32 { return binary.LittleEndian.Uint32(m.seg[12:]) }
+
+func (m conformanceMessage) String() string {
+	return fmt.Sprintf("%d %x %x %x", m.channel, m.cookie, m.seg, m.payload)
+}
+
+// kcpSegments splits the kcp data of a reliable datagram into segments
+func kcpSegments(kcpData []byte) ([][]byte, error) {
+	var segs [][]byte
+	for len(kcpData) > 0 {
+		if len(kcpData) < kcpOverhead {
+			return nil, errors.Errorf("short kcp segment %x", kcpData)
+		}
+		n := kcpOverhead + int(binary.LittleEndian.Uint32(kcpData[20:]))
+		if n > len(kcpData) {
+			return nil, errors.Errorf("kcp segment longer than the datagram %x", kcpData)
+		}
+		segs = append(segs, kcpData[:n])
+		kcpData = kcpData[n:]
+	}
+	return segs, nil
+}
+
+// conformanceMessages returns the messages of a datagram, one per kcp segment of a reliable one
+func conformanceMessages(data []byte) ([]conformanceMessage, error) {
+	if len(data) < headerSize {
+		return nil, errors.Errorf("short datagram %x", data)
+	}
+	channel, cookie := Channel(data[0]), data[1:headerSize]
+	if channel != Reliable {
+		return []conformanceMessage{{channel: channel, cookie: cookie, payload: data[headerSize:]}}, nil
+	}
+	segs, err := kcpSegments(data[headerSize:])
+	if err != nil {
+		return nil, err
+	}
+	var msgs []conformanceMessage
+	for _, seg := range segs {
+		msgs = append(msgs, conformanceMessage{channel: channel, cookie: cookie, seg: seg[:kcpOverhead], payload: seg[kcpOverhead:]})
+	}
+	return msgs, nil
+}
+
+type replay struct {
+	t     *testing.T
+	rec   int
+	peer  *netsim.Conn
+	addr  net.Addr // of the Go side
+	sessC <-chan *Session
+	s     *Session
+
+	cookies, convs map[string][]byte // recorded value -> the Go side's
+	// kcp retransmits, a PUSH is only a new message the first time its sn is seen
+	inSeen, recSeen, outSeen map[uint32]bool
+	pending                  []conformanceMessage // received from the Go side, not compared yet
+}
+
+func newReplay(t *testing.T, peer *netsim.Conn, addr net.Addr, sessC <-chan *Session) *replay {
+	r := &replay{t: t, peer: peer, addr: addr, sessC: sessC,
+		cookies: make(map[string][]byte), convs: make(map[string][]byte),
+		inSeen: make(map[uint32]bool), recSeen: make(map[uint32]bool), outSeen: make(map[uint32]bool)}
+	t.Cleanup(func() {
+		if r.s != nil {
+			r.s.Close()
+		}
+	})
+	return r
+}
+
+func (r *replay) run(records []trace.Record) {
+	for i, rec := range records {
+		r.rec = i + 1
+		switch rec.Dir {
+		case trace.In:
+			r.in(rec.Data)
+		case trace.Out:
+			r.out(rec.Data)
+		default:
+			r.fatalf("unknown direction %q", rec.Dir)
+		}
+	}
+}
+
+func (r *replay) fatalf(format string, args ...any) {
+	r.t.Helper()
+	r.t.Fatalf("record %d: %s", r.rec, fmt.Sprintf(format, args...))
+}
+
+// session is the Go side's session once it's accepted or dialled
+func (r *replay) session() *Session {
+	r.t.Helper()
+	if r.s == nil {
+		select {
+		case r.s = <-r.sessC:
+		case <-time.After(5 * time.Second):
+			r.fatalf("no session")
+		}
+	}
+	return r.s
+}
+
+// in writes a record to the Go side, with the cookie and convs it chose, and checks what it
+// reads from it
+func (r *replay) in(data []byte) {
+	r.t.Helper()
+	data = append([]byte(nil), data...)
+	if len(data) >= headerSize {
+		substitute(r.cookies, data[1:headerSize])
+	}
+	if len(data) > headerSize && Channel(data[0]) == Reliable {
+		segs, err := kcpSegments(data[headerSize:])
+		if err != nil {
+			r.fatalf("%v", err)
+		}
+		for _, seg := range segs {
+			substitute(r.convs, seg[:4])
+		}
+	}
+	if _, err := r.peer.WriteTo(data, r.addr); err != nil {
+		r.fatalf("%v", err)
+	}
+
+	msgs, err := conformanceMessages(data)
+	if err != nil {
+		r.fatalf("%v", err)
+	}
+	for _, m := range msgs {
+		if m.channel == Unreliable {
+			r.expectRead(Unreliable, m.payload)
+			continue
+		}
+		if !m.isPush() || r.inSeen[m.sn()] {
+			continue
+		}
+		r.inSeen[m.sn()] = true
+		switch Kcp2kOpcode(m.payload[0]) {
+		case Data:
+			r.expectRead(Reliable, m.payload[1:])
+		case Disconnect:
+			r.expectDisconnect()
+		}
+	}
+}
+
+// out makes the Go side send what a record carries, unless it does so by itself, and compares
+func (r *replay) out(data []byte) {
+	r.t.Helper()
+	msgs, err := conformanceMessages(data)
+	if err != nil {
+		r.fatalf("%v", err)
+	}
+	for _, want := range msgs {
+		if want.isPush() {
+			if r.recSeen[want.sn()] {
+				continue
+			}
+			r.recSeen[want.sn()] = true
+		}
+
+		var err error
+		switch {
+		case want.channel == Unreliable:
+			_, err = r.session().Send(want.payload, Unreliable)
+		case !want.isPush():
+			// ACKs follow from what the peer sent
+		case Kcp2kOpcode(want.payload[0]) == Ping:
+			_, err = r.session().sendReliable(Ping, nil)
+		case Kcp2kOpcode(want.payload[0]) == Data:
+			_, err = r.session().Send(want.payload[1:], Reliable)
+		case Kcp2kOpcode(want.payload[0]) == Disconnect:
+			r.session().Close()
+		}
+		if err != nil {
+			r.fatalf("Send: %v", err)
+		}
+		r.compare(want, r.next())
+	}
+}
+
+// next returns the next message from the Go side, kcp retransmissions skipped
+func (r *replay) next() conformanceMessage {
+	r.t.Helper()
+	buf := make([]byte, mtuLimit)
+	for len(r.pending) == 0 {
+		r.peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := r.peer.ReadFrom(buf)
+		if err != nil {
+			r.fatalf("no answer: %v", err)
+		}
+		msgs, err := conformanceMessages(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			r.fatalf("%v", err)
+		}
+		for _, m := range msgs {
+			if m.isPush() {
+				if r.outSeen[m.sn()] {
+					continue
+				}
+				r.outSeen[m.sn()] = true
+			}
+			r.pending = append(r.pending, m)
+		}
+	}
+	m := r.pending[0]
+	r.pending = r.pending[1:]
+	return m
+}
+
+// compare checks a message from the Go side against the trace's, all but ts and wnd of a kcp header
+func (r *replay) compare(want, got conformanceMessage) {
+	r.t.Helper()
+	ok := got.channel == want.channel && bytes.Equal(got.payload, want.payload) &&
+		bind(r.cookies, want.cookie, got.cookie)
+	if ok && want.channel == Reliable {
+		ok = bind(r.convs, want.seg[:4], got.seg[:4]) && bytes.Equal(got.seg[4:6], want.seg[4:6]) &&
+			bytes.Equal(got.seg[12:], want.seg[12:])
+	}
+	if !ok {
+		r.fatalf("got %v, want %v", got, want)
+	}
+}
+
+func (r *replay) expectRead(channel Channel, want []byte) {
+	r.t.Helper()
+	s := r.session()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, ReliableMaxMessageSize)
+	n, got, err := s.Read(buf)
+	if err != nil {
+		r.fatalf("Read: %v", err)
+	}
+	if got != channel || !bytes.Equal(buf[:n], want) {
+		r.fatalf("read %x on %s, want %x on %s", buf[:n], got, want, channel)
+	}
+}
+
+func (r *replay) expectDisconnect() {
+	r.t.Helper()
+	s := r.session()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := s.Read(make([]byte, ReliableMaxMessageSize))
+	var derr *DisconnectError
+	if !errors.As(err, &derr) || derr.Code != ConnectionClosed {
+		r.fatalf("Read returned %v, want a ConnectionClosed DisconnectError", err)
+	}
+}
+
+// bind checks that the Go side sent the value bound to a recorded one, binding it the first time.
+// Zero is never bound, a zero cookie must be sent as is
+func bind(m map[string][]byte, recorded, actual []byte) bool {
+	zero := make([]byte, len(recorded))
+	if bytes.Equal(recorded, zero) || bytes.Equal(actual, zero) {
+		return bytes.Equal(actual, recorded)
+	}
+	if v, ok := m[string(recorded)]; ok {
+		return bytes.Equal(actual, v)
+	}
+	m[string(recorded)] = append([]byte(nil), actual...)
+	return true
+}
+
+// substitute replaces a recorded value the Go side was bound to in place
+func substitute(m map[string][]byte, b []byte) {
+	if v, ok := m[string(b)]; ok {
+		copy(b, v)
+	}
+}
+
+func loadTrace(t *testing.T, path string) []trace.Record {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := trace.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestConformance(t *testing.T) {
+	paths, err := filepath.Glob("testdata/conformance/*.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no traces")
+	}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		t.Run(name, func(t *testing.T) {
+			records := loadTrace(t, path)
+			peer, conn := netsim.Pipe(1, netsim.Link{}, netsim.Link{})
+			defer peer.Close()
+			defer conn.Close()
+
+			sessC := make(chan *Session, 1)
+			switch {
+			case strings.HasPrefix(name, "listener"):
+				l, err := ServeConn(conn, WithPingInterval(conformancePingInterval))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer l.Close()
+				go func() {
+					if s, err := l.Accept(); err == nil {
+						sessC <- s
+					}
+				}()
+			case strings.HasPrefix(name, "session"):
+				go func() {
+					if s, err := DialConn(conn, peer.LocalAddr(), WithPingInterval(conformancePingInterval)); err == nil {
+						sessC <- s
+					}
+				}()
+			default:
+				t.Fatal("a trace is named listener* or session*")
+			}
+			newReplay(t, peer, conn.LocalAddr(), sessC).run(records)
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package kcp2k
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+)
+
+var (
+	errInvalidOperation = errors.New("invalid operation")
+
+	// ErrTimeout is returned when a deadline set on Accept or Read expires,
+	// and wrapped when a peer stops answering pings. It implements net.Error
+	ErrTimeout error = timeoutError{}
+	// ErrClosed is returned once a Listener or Session is closed. It is io.ErrClosedPipe,
+	// so existing checks against that keep working
+	ErrClosed = io.ErrClosedPipe
+	// ErrBufferTooSmall is returned by Read when an unreliable message doesn't fit the buffer
+	ErrBufferTooSmall = errors.New("kcp2k: buffer too small")
+	// ErrHandshake matches every handshake failure
+	ErrHandshake = errors.New("kcp2k: handshake failed")
+	// ErrInvalidCookie is returned when a datagram carries a cookie other than the session's
+	ErrInvalidCookie = errors.New("kcp2k: invalid cookie")
+	// ErrMessageTooLarge is returned by Send when data exceeds the channel's max message size
+	ErrMessageTooLarge = errors.New("kcp2k: message too large")
+	// ErrRateLimited is wrapped in the DisconnectError of a session dropped for exceeding its RateLimit
+	ErrRateLimited = errors.New("kcp2k: inbound rate limit exceeded")
+	// ErrReconnecting is returned by ReconnectingClient.Send when a message is dropped during a reconnect
+	ErrReconnecting = errors.New("kcp2k: reconnecting")
+	// ErrSuspended is returned by Send when a message can't be buffered for a suspended session
+	ErrSuspended = errors.New("kcp2k: session suspended")
+	// ErrWindowFull is returned when a reliable message is skipped instead of waiting for
+	// the peer to ack a full kcp send window
+	ErrWindowFull = errors.New("kcp2k: send window full")
+)
+
+const (
+	// UnreliableMaxMessageSize is the largest payload Send accepts on the Unreliable channel
+	UnreliableMaxMessageSize = mtuLimit - headerSize
+	// ReliableMaxMessageSize follows kcp2k: a message may span at most rcv_wnd-1 kcp fragments,
+	// one byte is taken by the opcode
+	ReliableMaxMessageSize = (kcpWndRcv-1)*(kcpMtu-kcpOverhead) - 1
+)
+
+// kcp-go defaults
+const (
+	kcpMtu      = 1400
+	kcpOverhead = 24
+	kcpCmdPush  = 81 // IKCP_CMD_PUSH
+	kcpWndRcv   = 32
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "kcp2k: timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// ErrorCode classifies why a session was disconnected, following kcp2k's ErrorCode
+type ErrorCode byte
+
+const (
+	DnsResolve       ErrorCode = iota // failed to resolve a host name
+	Timeout                           // ping timeout or dead link
+	Congestion                        // more messages than transport / network can process
+	InvalidReceive                    // recv invalid packet (possibly intentional attack)
+	InvalidSend                       // user tried to send invalid data
+	ConnectionClosed                  // connection closed voluntarily or lost involuntarily
+	Unexpected                        // unexpected error / exception, requires fix
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case DnsResolve:
+		return "DnsResolve"
+	case Timeout:
+		return "Timeout"
+	case Congestion:
+		return "Congestion"
+	case InvalidReceive:
+		return "InvalidReceive"
+	case InvalidSend:
+		return "InvalidSend"
+	case ConnectionClosed:
+		return "ConnectionClosed"
+	case Unexpected:
+		return "Unexpected"
+	default:
+		return fmt.Sprintf("ErrorCode(%d)", byte(c))
+	}
+}
+
+// DisconnectError is returned by Session.Read and Send after the session was
+// disconnected for any reason other than a local Close
+type DisconnectError struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (e *DisconnectError) Error() string {
+	return fmt.Sprintf("kcp2k: disconnected (%s): %v", e.Code, e.Err)
+}
+
+func (e *DisconnectError) Unwrap() error { return e.Err }
+
+// BroadcastError is returned by Broadcast, BroadcastFunc, Multicast and Group.Send when a
+// session wasn't sent to. Skipped holds the ids of sessions whose kcp send window was full,
+// Err the first other send error. It matches ErrWindowFull while Skipped isn't empty
+type BroadcastError struct {
+	Skipped []uint64
+	Err     error
+}
+
+func (e *BroadcastError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%v: skipped %d sessions", ErrWindowFull, len(e.Skipped))
+	}
+	return fmt.Sprintf("kcp2k: broadcast skipped %d sessions, failed: %v", len(e.Skipped), e.Err)
+}
+
+func (e *BroadcastError) Unwrap() []error {
+	var errs []error
+	if len(e.Skipped) > 0 {
+		errs = append(errs, ErrWindowFull)
+	}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
@@ -0,0 +1,107 @@
+package kcp2k
+
+import (
+	"fmt"
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// isSentinel checks err against target as returned and wrapped again by a caller
+func isSentinel(t *testing.T, what string, err, target error) {
+	t.Helper()
+	for _, e := range []error{err, errors.WithStack(err), errors.Wrap(err, "caller"), fmt.Errorf("caller: %w", err)} {
+		if !errors.Is(e, target) {
+			t.Fatalf("%s returned %v, which doesn't match %v", what, e, target)
+		}
+	}
+}
+
+func TestErrorSentinels(t *testing.T) {
+	n := netsim.New(1)
+	l, lconn := serve(t, n, WithLogger(discardLogger))
+	defer lconn.Close()
+	defer l.Close()
+	c, cconn := dial(t, n, l, WithLogger(discardLogger))
+	defer cconn.Close()
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetReadDeadline(time.Now())
+	_, _, err = c.Read(make([]byte, mtuLimit))
+	isSentinel(t, "Read past its deadline", err, ErrTimeout)
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("Read returned %v, want a timeout net.Error", err)
+	}
+	c.SetReadDeadline(time.Time{})
+
+	l.SetReadDeadline(time.Now())
+	_, err = l.Accept()
+	isSentinel(t, "Accept past its deadline", err, ErrTimeout)
+	l.SetReadDeadline(time.Time{})
+
+	_, err = c.Send(make([]byte, ReliableMaxMessageSize+1), Reliable)
+	isSentinel(t, "Send of a too large reliable message", err, ErrMessageTooLarge)
+	_, err = c.Send(make([]byte, UnreliableMaxMessageSize+1), Unreliable)
+	isSentinel(t, "Send of a too large unreliable message", err, ErrMessageTooLarge)
+
+	if _, err := s.Send([]byte("unreliable"), Unreliable); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = c.Read(make([]byte, 1))
+	isSentinel(t, "Read into a short buffer", err, ErrBufferTooSmall)
+
+	// the server closes, the client sees the peer's Disconnect
+	s.Close()
+	_, err = s.Send([]byte("x"), Reliable)
+	isSentinel(t, "Send on a closed session", err, ErrClosed)
+	isSentinel(t, "Send on a closed session", err, io.ErrClosedPipe)
+	_, _, err = s.Read(make([]byte, mtuLimit))
+	isSentinel(t, "Read on a closed session", err, ErrClosed)
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = c.Read(make([]byte, mtuLimit))
+	var derr *DisconnectError
+	if !errors.As(errors.WithStack(err), &derr) || derr.Code != ConnectionClosed {
+		t.Fatalf("Read returned %v, want a ConnectionClosed DisconnectError", err)
+	}
+	isSentinel(t, "Read after the peer disconnected", err, ErrClosed)
+
+	l.Close()
+	_, err = l.Accept()
+	isSentinel(t, "Accept on a closed listener", err, ErrClosed)
+
+	if err := c.CheckCookie([]byte{0xde, 0xad, 0xbe, 0xef}); err != nil {
+		isSentinel(t, "CheckCookie", err, ErrInvalidCookie)
+	} else {
+		t.Fatal("CheckCookie accepted a wrong cookie")
+	}
+}
+
+func TestHandshakeErrorSentinels(t *testing.T) {
+	// a server that never answers
+	silent, conn := netsim.Pipe(1, netsim.Link{}, netsim.Link{})
+	defer silent.Close()
+	defer conn.Close()
+
+	_, err := DialConn(conn, silent.LocalAddr(), WithLogger(discardLogger), WithHandshakeTimeout(50*time.Millisecond))
+	isSentinel(t, "DialConn to a silent server", err, ErrHandshake)
+	isSentinel(t, "DialConn to a silent server", err, ErrTimeout)
+	if reason := handshakeFailReason(errors.WithStack(err)); reason != HandshakeTimeout {
+		t.Fatalf("handshake failed with %s, want timeout", reason)
+	}
+
+	_, err = DialWithOptions("host.invalid:7777", WithLogger(discardLogger))
+	var derr *DisconnectError
+	if !errors.As(errors.WithStack(err), &derr) || derr.Code != DnsResolve {
+		t.Fatalf("DialWithOptions returned %v, want a DnsResolve DisconnectError", err)
+	}
+}
@@ -0,0 +1,119 @@
+package kcp2k
+
+import "sync"
+
+// Group is a set of a Listener's sessions, such as a lobby or a match, that can be sent to
+// together. Sessions leave every group automatically when they close
+type Group struct {
+	l *Listener
+
+	mu      sync.Mutex
+	members map[uint64]*Session
+	onEmpty func(*Group)
+}
+
+func (l *Listener) NewGroup() *Group {
+	return &Group{
+		l:       l,
+		members: make(map[uint64]*Session),
+	}
+}
+
+// OnEmpty sets a hook called whenever the last member leaves or closes
+func (g *Group) OnEmpty(fn func(*Group)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.onEmpty = fn
+}
+
+// Join adds s to the group. It returns false if s is closed or belongs to another listener.
+// s.die is checked under s.mu, after which Session.close no longer misses the group
+func (g *Group) Join(s *Session) bool {
+	if s.l != g.l {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	s.mu.Lock()
+	select {
+	case <-s.die:
+		s.mu.Unlock()
+		return false
+	default:
+	}
+	if s.groups == nil {
+		s.groups = make(map[*Group]struct{})
+	}
+	s.groups[g] = struct{}{}
+	s.mu.Unlock()
+
+	g.members[s.id] = s
+	return true
+}
+
+// Leave removes s from the group
+func (g *Group) Leave(s *Session) {
+	g.remove(s)
+}
+
+// remove takes s out of the group and the group out of s.groups in one critical section,
+// locking the group before the session like Join does
+func (g *Group) remove(s *Session) {
+	g.mu.Lock()
+	s.mu.Lock()
+	delete(s.groups, g)
+	s.mu.Unlock()
+	if g.members[s.id] != s {
+		g.mu.Unlock()
+		return
+	}
+	delete(g.members, s.id)
+	onEmpty := g.onEmpty
+	empty := len(g.members) == 0
+	g.mu.Unlock()
+
+	if empty && onEmpty != nil {
+		onEmpty(g)
+	}
+}
+
+// Contains reports whether s is a member
+func (g *Group) Contains(s *Session) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.members[s.id] == s
+}
+
+// Members returns a snapshot of the group's sessions
+func (g *Group) Members() []*Session {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	members := make([]*Session, 0, len(g.members))
+	for _, s := range g.members {
+		members = append(members, s)
+	}
+	return members
+}
+
+func (g *Group) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.members)
+}
+
+// Send sends data to every member, see Listener.Broadcast
+func (g *Group) Send(data []byte, channel Channel) (int, error) {
+	m, err := g.l.newMulticast(data, channel)
+	if err != nil {
+		return 0, err
+	}
+	defer m.release()
+
+	for _, s := range g.Members() {
+		m.send(s)
+	}
+	return m.result()
+}
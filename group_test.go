@@ -0,0 +1,77 @@
+package kcp2k
+
+import (
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// TestGroupJoinLeaveClose is meant for -race: sessions join and leave groups from several
+// goroutines while half of them close, then every group and session must agree
+func TestGroupJoinLeaveClose(t *testing.T) {
+	n := netsim.New(1)
+	l, lconn := serve(t, n, WithLogger(discardLogger))
+	defer lconn.Close()
+	defer l.Close()
+
+	var sessions []*Session
+	for i := 0; i < 6; i++ {
+		c, cconn := dial(t, n, l, WithLogger(discardLogger))
+		defer cconn.Close()
+		defer c.Close()
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, s)
+	}
+	groups := []*Group{l.NewGroup(), l.NewGroup(), l.NewGroup()}
+
+	var wg sync.WaitGroup
+	for i, s := range sessions {
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(s *Session, seed int64) {
+				defer wg.Done()
+				r := rand.New(rand.NewSource(seed))
+				for k := 0; k < 2000; k++ {
+					g := groups[r.Intn(len(groups))]
+					if r.Intn(2) == 0 {
+						g.Join(s)
+					} else {
+						g.Leave(s)
+					}
+				}
+			}(s, int64(i*4+j))
+		}
+		if i%2 == 0 {
+			wg.Add(1)
+			go func(s *Session) {
+				defer wg.Done()
+				s.Close()
+			}(s)
+		}
+	}
+	wg.Wait()
+
+	for i, s := range sessions {
+		s.mu.Lock()
+		joined := s.groups
+		s.mu.Unlock()
+		for _, g := range groups {
+			_, ok := joined[g]
+			switch {
+			case i%2 == 0 && (ok || g.Contains(s)):
+				t.Fatalf("closed session %d still in a group", s.ID())
+			case ok != g.Contains(s):
+				t.Fatalf("session %d has the group %t, the group has the session %t", s.ID(), ok, g.Contains(s))
+			}
+		}
+	}
+	for _, g := range groups {
+		if g.Join(sessions[0]) {
+			t.Fatal("a closed session joined")
+		}
+	}
+}
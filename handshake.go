@@ -0,0 +1,88 @@
+package kcp2k
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"net"
+	"time"
+)
+
+const HandshakeTimeoutDefault = time.Second * 5
+
+// HandshakeFailReason tells why a handshake failed
+type HandshakeFailReason byte
+
+const (
+	HandshakeTimeout        HandshakeFailReason = iota // no kcp session or no Hello within the handshake timeout
+	HandshakeWrongOpcode                               // the first reliable message wasn't Hello
+	HandshakeCookieMismatch                            // a datagram carried a cookie that isn't the session's
+	HandshakeCollision                                 // a second kcp session arrived for an address mid-handshake
+	HandshakeAborted                                   // the session was closed or its kcp session failed
+	HandshakeInvalidHello                              // the server's Hello resumed a session the client didn't ask for
+)
+
+func (r HandshakeFailReason) String() string {
+	switch r {
+	case HandshakeTimeout:
+		return "timeout"
+	case HandshakeWrongOpcode:
+		return "wrong_opcode"
+	case HandshakeCookieMismatch:
+		return "cookie_mismatch"
+	case HandshakeCollision:
+		return "collision"
+	case HandshakeAborted:
+		return "aborted"
+	case HandshakeInvalidHello:
+		return "invalid_hello"
+	default:
+		return "unknown"
+	}
+}
+
+// handshakeErr is matched by errors.Is(err, ErrHandshake)
+type handshakeErr struct {
+	reason HandshakeFailReason
+	err    error
+}
+
+func handshakeError(reason HandshakeFailReason, err error) error {
+	return errors.WithStack(&handshakeErr{reason: reason, err: err})
+}
+
+func (e *handshakeErr) Error() string {
+	return fmt.Sprintf("%v (%s): %v", ErrHandshake, e.reason, e.err)
+}
+
+func (e *handshakeErr) Unwrap() error { return e.err }
+
+func (e *handshakeErr) Is(target error) bool { return target == ErrHandshake }
+
+func handshakeFailReason(err error) HandshakeFailReason {
+	var herr *handshakeErr
+	if errors.As(err, &herr) {
+		return herr.reason
+	}
+	return HandshakeAborted
+}
+
+// handshakeFailed closes a session whose handshake failed, which also removes it
+// from the listener, and reports it through the OnHandshakeFailed hook
+func (s *Session) handshakeFailed(err error) {
+	if !s.close(reasonClosed, err) {
+		// already closed, and reported if that was a failed handshake
+		return
+	}
+
+	reason := handshakeFailReason(err)
+	if s.l != nil {
+		s.l.metrics.handshakesRejected.Add(1)
+	}
+	if s.cfg.onHandshakeFailed != nil {
+		s.cfg.onHandshakeFailed(s.RemoteAddr(), reason)
+	}
+	s.cfg.warnLimiter.warn(s.logger(), "handshake failed", "reason", reason.String(), "error", err)
+}
+
+// OnHandshakeFailedFunc is called with the peer address and the reason of every failed handshake
+type OnHandshakeFailedFunc func(addr net.Addr, reason HandshakeFailReason)
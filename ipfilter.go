@@ -0,0 +1,166 @@
+package kcp2k
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// AdmitFunc decides whether a datagram from an unknown address may start a handshake.
+// It runs on the listener's read loop, so it must not block
+type AdmitFunc func(addr netip.AddrPort) bool
+
+// IPFilter is a runtime-mutable admission policy made of CIDR allow and deny lists
+// and a ban list with expiry. Pass IPFilter.Admit to WithAdmitFunc
+type IPFilter struct {
+	mu     sync.RWMutex
+	allow  []netip.Prefix
+	deny   []netip.Prefix
+	banned map[netip.Addr]time.Time // zero time bans forever
+	clock  Clock
+}
+
+func NewIPFilter() *IPFilter {
+	return &IPFilter{banned: make(map[netip.Addr]time.Time), clock: realClock{}}
+}
+
+// SetClock replaces the real clock bans expire on, pass the listener's WithClock clock in tests
+func (f *IPFilter) SetClock(clock Clock) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if clock != nil {
+		f.clock = clock
+	}
+}
+
+// Allow adds prefix to the allow list. Once the allow list is non-empty,
+// only addresses inside it are admitted
+func (f *IPFilter) Allow(prefix netip.Prefix) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allow = appendPrefix(f.allow, normalizePrefix(prefix))
+}
+
+func (f *IPFilter) RemoveAllow(prefix netip.Prefix) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.allow = removePrefix(f.allow, normalizePrefix(prefix))
+}
+
+// Deny adds prefix to the deny list, which takes precedence over the allow list
+func (f *IPFilter) Deny(prefix netip.Prefix) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deny = appendPrefix(f.deny, normalizePrefix(prefix))
+}
+
+func (f *IPFilter) RemoveDeny(prefix netip.Prefix) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deny = removePrefix(f.deny, normalizePrefix(prefix))
+}
+
+// Ban rejects addr for d, d<=0 bans until Unban
+func (f *IPFilter) Ban(addr netip.Addr, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.clock.Now()
+	var until time.Time
+	if d > 0 {
+		until = now.Add(d)
+	}
+	f.pruneBans(now)
+	f.banned[addr.Unmap()] = until
+}
+
+func (f *IPFilter) Unban(addr netip.Addr) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.banned, addr.Unmap())
+}
+
+// Banned returns the currently banned addresses and when each ban expires, zero meaning never
+func (f *IPFilter) Banned() map[netip.Addr]time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pruneBans(f.clock.Now())
+
+	bans := make(map[netip.Addr]time.Time, len(f.banned))
+	for addr, until := range f.banned {
+		bans[addr] = until
+	}
+	return bans
+}
+
+func (f *IPFilter) pruneBans(now time.Time) {
+	for addr, until := range f.banned {
+		if !until.IsZero() && !now.Before(until) {
+			delete(f.banned, addr)
+		}
+	}
+}
+
+// Admit implements AdmitFunc. Expired bans are ignored here and pruned by Banned
+func (f *IPFilter) Admit(addrPort netip.AddrPort) bool {
+	addr := addrPort.Addr().Unmap()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if until, ok := f.banned[addr]; ok && (until.IsZero() || f.clock.Now().Before(until)) {
+		return false
+	}
+	for _, p := range f.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePrefix masks prefix and turns an IPv4-mapped IPv6 prefix into its IPv4 one,
+// Admit matches unmapped addresses
+func normalizePrefix(prefix netip.Prefix) netip.Prefix {
+	if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked()
+}
+
+func appendPrefix(prefixes []netip.Prefix, prefix netip.Prefix) []netip.Prefix {
+	for _, p := range prefixes {
+		if p == prefix {
+			return prefixes
+		}
+	}
+	return append(prefixes, prefix)
+}
+
+func removePrefix(prefixes []netip.Prefix, prefix netip.Prefix) []netip.Prefix {
+	out := prefixes[:0:0]
+	for _, p := range prefixes {
+		if p != prefix {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// addrPortOf converts a net.Addr from ReadFrom to a netip.AddrPort
+func addrPortOf(addr net.Addr) netip.AddrPort {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.AddrPort()
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap
+}
@@ -0,0 +1,99 @@
+package kcp2k
+
+import (
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIPFilterAllowDeny(t *testing.T) {
+	f := NewIPFilter()
+	f.Allow(netip.MustParsePrefix("203.0.113.0/24"))
+	f.Allow(netip.MustParsePrefix("2001:db8::/32"))
+	f.Allow(netip.MustParsePrefix("::ffff:192.0.2.0/120"))
+	f.Deny(netip.MustParsePrefix("203.0.113.128/25"))
+	f.Deny(netip.MustParsePrefix("2001:db8:bad::/48"))
+	f.Deny(netip.MustParsePrefix("::ffff:192.0.2.7/128"))
+
+	for _, c := range []struct {
+		addr  string
+		admit bool
+	}{
+		{"203.0.113.1", true},
+		{"::ffff:203.0.113.1", true},
+		{"203.0.113.200", false},
+		{"::ffff:203.0.113.200", false},
+		{"198.51.100.1", false},
+		{"2001:db8::1", true},
+		{"2001:db8:bad::1", false},
+		{"2001:db9::1", false},
+		{"192.0.2.1", true},
+		{"::ffff:192.0.2.1", true},
+		{"192.0.2.7", false},
+		{"::ffff:192.0.2.7", false},
+	} {
+		if got := f.Admit(netip.AddrPortFrom(netip.MustParseAddr(c.addr), 7777)); got != c.admit {
+			t.Errorf("Admit(%s) = %t, want %t", c.addr, got, c.admit)
+		}
+	}
+
+	f.RemoveDeny(netip.MustParsePrefix("192.0.2.7/32"))
+	if !f.Admit(netip.MustParseAddrPort("192.0.2.7:7777")) {
+		t.Error("the IPv4-mapped deny wasn't removed by its IPv4 prefix")
+	}
+	f.RemoveAllow(netip.MustParsePrefix("203.0.113.0/24"))
+	if f.Admit(netip.MustParseAddrPort("203.0.113.1:7777")) {
+		t.Error("admitted after its allow prefix was removed")
+	}
+
+	// without an allow list everything not denied is admitted
+	f = NewIPFilter()
+	f.Deny(netip.MustParsePrefix("10.0.0.0/8"))
+	if f.Admit(netip.MustParseAddrPort("[::ffff:10.1.2.3]:1")) || !f.Admit(netip.MustParseAddrPort("[2001:db8::1]:1")) {
+		t.Error("deny list alone")
+	}
+}
+
+func TestDeniedAddressGetsNoSession(t *testing.T) {
+	f := NewIPFilter()
+	f.Deny(netip.MustParsePrefix("203.0.113.0/24"))
+	f.Ban(netip.MustParseAddr("2001:db8::bad"), 0)
+	n := netsim.New(1)
+	l, lconn := serve(t, n, WithLogger(discardLogger), WithAdmitFunc(f.Admit))
+	defer lconn.Close()
+	defer l.Close()
+
+	for _, addr := range []string{"203.0.113.5:1000", "[2001:db8::bad]:1000"} {
+		conn, err := n.Listen(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := DialConn(conn, l.Addr(), WithLogger(discardLogger), WithHandshakeTimeout(50*time.Millisecond)); err == nil {
+			t.Fatalf("%s dialled a listener that denies it", addr)
+		}
+
+		if n := l.sessionCount.Load(); n != 0 {
+			t.Fatalf("%d sessions after %s was denied", n, addr)
+		}
+		m := l.Metrics()
+		if m.AdmissionsRejected == 0 || m.PendingHandshakes != 0 || m.HandshakesRejected != 0 || m.ActiveSessions != 0 {
+			t.Fatalf("after %s was denied: %+v", addr, m)
+		}
+	}
+
+	conn, err := n.Listen("[2001:db8::1]:1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c, err := DialConn(conn, l.Addr(), WithLogger(discardLogger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if m := l.Metrics(); m.HandshakesAccepted != 1 {
+		t.Fatalf("%d handshakes accepted, want the admitted one", m.HandshakesAccepted)
+	}
+}
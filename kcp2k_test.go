@@ -0,0 +1,78 @@
+package kcp2k
+
+import (
+	"bytes"
+	"github.com/0990/kcp2k-go/pkg/leakcheck"
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"github.com/pkg/errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func FuzzParseKcp2kBodyData(f *testing.F) {
+	for _, seed := range [][]byte{nil, {byte(Hello)}, {byte(Data), 'h', 'i'}, {byte(Disconnect)}, {0xff, 0}} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		opcode, data, err := parseKcp2kBodyData(raw)
+		if len(raw) == 0 {
+			if err == nil {
+				t.Fatal("no error for an empty message")
+			}
+			return
+		}
+		if err != nil || opcode != Kcp2kOpcode(raw[0]) || !bytes.Equal(data, raw[1:]) {
+			t.Fatalf("parsed %x as %d %x %v", raw, opcode, data, err)
+		}
+	})
+}
+
+func FuzzHandleKCPRawData(f *testing.F) {
+	for _, seed := range [][]byte{nil, {byte(Hello)}, {byte(Ping)}, {byte(Data)}, {byte(Data), 'h', 'i'}, {byte(Disconnect)}, {0xff}} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		snap := leakcheck.Take()
+		a, b := netsim.Pipe(1, netsim.Link{}, netsim.Link{})
+		defer a.Close()
+		defer b.Close()
+		s := bareSession(a, b)
+
+		err := s.handleKCPRawData(raw)
+		var derr *DisconnectError
+		switch {
+		case len(raw) > 0 && Kcp2kOpcode(raw[0]) == Ping:
+			if err != nil || s.dead() {
+				t.Fatalf("ping returned %v", err)
+			}
+		case len(raw) > 0 && Kcp2kOpcode(raw[0]) == Data:
+			if err != nil {
+				t.Fatalf("data returned %v", err)
+			}
+			s.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, ReliableMaxMessageSize)
+			n, channel, err := s.Read(buf)
+			if err != nil || channel != Reliable || !bytes.Equal(buf[:n], raw[1:]) {
+				t.Fatalf("read %x on %s, %v", buf[:n], channel, err)
+			}
+		case len(raw) > 0 && Kcp2kOpcode(raw[0]) == Disconnect:
+			if !errors.As(err, &derr) || derr.Code != ConnectionClosed || !s.dead() {
+				t.Fatalf("disconnect returned %v", err)
+			}
+		default:
+			// anything else is a protocol violation and ends the session
+			if !errors.As(err, &derr) || derr.Code != InvalidReceive || !s.dead() {
+				t.Fatalf("%x returned %v", raw, err)
+			}
+		}
+
+		s.Close()
+		if err := snap.Check(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
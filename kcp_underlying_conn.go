@@ -7,12 +7,6 @@ import (
 	"sync/atomic"
 )
 
-var (
-	errInvalidOperation = errors.New("invalid operation")
-	errTimeout          = errors.New("timeout")
-	errBufferSmall      = errors.New("buffsmall")
-)
-
 const (
 	KCPMessageLimit = 128
 )
@@ -54,11 +48,14 @@ func (c *KcpUnderlyingConn) ReadFrom(p []byte) (n int, addr net.Addr, err error)
 	select {
 	case msg := <-c.chReadMessages:
 		data := msg.Data
+		defer xmitBuf.Put(data)
 		if len(p) < len(data) {
-			return 0, nil, errors.WithStack(errBufferSmall)
+			return 0, nil, errors.WithStack(ErrBufferTooSmall)
 		}
 		n = copy(p, data)
 		return n, msg.Addr, nil
+	case <-c.chSocketReadError:
+		return 0, nil, c.socketReadError.Load().(error)
 	}
 }
 
@@ -73,9 +70,16 @@ func (c *KcpUnderlyingConn) WriteTo(p []byte, addr net.Addr) (n int, err error)
 }
 
 func (c *KcpUnderlyingConn) packetInput(data []byte, addr net.Addr) {
-	c.chReadMessages <- KCPMessage{
-		Data: data,
+	// data belongs to the read loop's buffer
+	buf := xmitBuf.Get().([]byte)[:len(data)]
+	copy(buf, data)
+	select {
+	case c.chReadMessages <- KCPMessage{
+		Data: buf,
 		Addr: addr,
+	}:
+	case <-c.chSocketReadError:
+		xmitBuf.Put(buf)
 	}
 }
 
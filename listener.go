@@ -4,10 +4,8 @@ import (
 	"github.com/0990/kcp-go"
 	"github.com/0990/kcp2k-go/pkg/syncx"
 	"github.com/pkg/errors"
-	"io"
-	"log"
-	"log/slog"
 	"net"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,12 +16,25 @@ const (
 	acceptBacklog = 128
 )
 
+// Listener accepts kcp2k sessions. All its methods are safe for concurrent use, including
+// with the methods of the sessions it accepted
 type Listener struct {
-	conn net.PacketConn
-
-	kcpConn *KcpUnderlyingConn
-
-	sessions syncx.Map[string, *Session]
+	conn    net.PacketConn
+	ownConn bool // true if we created conn internally, false if provided by caller
+	cfg     *config
+
+	kcpConn     *KcpUnderlyingConn
+	kcpListener *kcp.Listener
+
+	sessions          syncx.Map[string, *Session]
+	sessionsByID      syncx.Map[uint64, *Session] // sessions that completed the handshake
+	resumable         syncx.Map[string, *Session] // authenticated sessions by resume token
+	suspended         syncx.Map[string, *Session] // suspended sessions by resume token
+	nextID            atomic.Uint64
+	sessionCount      atomic.Int64 // sessions in the table, pending ones included
+	pendingHandshakes atomic.Int64
+	ipMu              sync.Mutex
+	ipSessions        map[netip.Addr]int // only tracked when MaxSessionsPerIP is set
 
 	chAccepts       chan *Session // Listen() backlog
 	chSessionClosed chan net.Addr // session close queue
@@ -37,9 +48,13 @@ type Listener struct {
 	socketReadErrorOnce sync.Once
 
 	rd atomic.Value // read deadline for Accept()
+
+	monitorDone chan struct{}
+
+	metrics listenerMetrics
 }
 
-func ListenWithOptions(laddr string) (*Listener, error) {
+func ListenWithOptions(laddr string, opts ...Option) (*Listener, error) {
 	udpaddr, err := net.ResolveUDPAddr("udp", laddr)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -49,12 +64,20 @@ func ListenWithOptions(laddr string) (*Listener, error) {
 		return nil, errors.WithStack(err)
 	}
 
-	return serveConn(conn)
+	return serveConn(conn, true, newConfig(opts))
 }
 
-func serveConn(conn net.PacketConn) (*Listener, error) {
+// ServeConn serves kcp2k over a caller-provided conn. Listener.Close leaves it open and free to reuse
+func ServeConn(conn net.PacketConn, opts ...Option) (*Listener, error) {
+	return serveConn(conn, false, newConfig(opts))
+}
+
+func serveConn(conn net.PacketConn, ownConn bool, cfg *config) (*Listener, error) {
 	l := new(Listener)
 	l.conn = conn
+	l.ownConn = ownConn
+	l.cfg = cfg
+	l.ipSessions = make(map[netip.Addr]int)
 	l.kcpConn = newKcpUnderlyingConn(conn, func(addr net.Addr) (KCPOutput, error) {
 		sess, ok := l.sessions.Load(addr.String())
 		if !ok {
@@ -62,12 +85,18 @@ func serveConn(conn net.PacketConn) (*Listener, error) {
 		}
 		return sess, nil
 	})
-	l.listenKCP()
 
 	l.chAccepts = make(chan *Session, acceptBacklog)
 	l.chSessionClosed = make(chan net.Addr)
 	l.die = make(chan struct{})
 	l.chSocketReadError = make(chan struct{})
+	l.monitorDone = make(chan struct{})
+
+	kcpListener, err := l.listenKCP()
+	if err != nil {
+		return nil, err
+	}
+	l.kcpListener = kcpListener
 	go l.monitor()
 
 	return l, nil
@@ -76,19 +105,24 @@ func serveConn(conn net.PacketConn) (*Listener, error) {
 func (l *Listener) listenKCP() (*kcp.Listener, error) {
 	kcpListener, err := kcp.ServeConn(nil, 0, 0, l.kcpConn)
 	if err != nil {
-		return nil, err
+		return nil, errors.WithStack(err)
 	}
 
 	go func() {
 		for {
 			s, err := kcpListener.AcceptKCP()
 			if err != nil {
-				log.Fatal(err)
+				select {
+				case <-l.die:
+				default:
+					l.notifyReadError(errors.WithStack(err))
+				}
+				return
 			}
 			go func() {
 				err := l.handleNewKcp(s)
 				if err != nil {
-					slog.Warn("handleNewKcp error", "error", err)
+					l.notifyError(errors.Wrapf(err, "handleNewKcp %s", s.RemoteAddr()))
 				}
 			}()
 		}
@@ -101,18 +135,24 @@ func (l *Listener) handleNewKcp(sess *kcp.UDPSession) error {
 
 	s, _ := l.sessions.Load(addr)
 	if s == nil {
+		sess.Close()
 		return errors.New("s==nil")
 	}
 
 	ok := s.SetKcpSession(sess)
 	if !ok {
-		l.sessions.Delete(addr)
-		return errors.New("s.kcpSess!=nil")
+		// only the new kcp session goes, an established session is left alone
+		sess.Close()
+		if s.isPending() {
+			s.handshakeFailed(handshakeError(HandshakeCollision, errors.New("s.kcpSess!=nil")))
+			return nil
+		}
+		return errors.Errorf("second kcp session for established session %d", s.id)
 	}
 
 	err := s.Run()
 	if err != nil {
-		return err
+		s.handshakeFailed(err)
 	}
 	return nil
 }
@@ -122,30 +162,83 @@ func ReadPacket(session *kcp.UDPSession) ([]byte, error) {
 }
 
 func (l *Listener) Accept() (*Session, error) {
-	var timeout <-chan time.Time
-	if tdeadline, ok := l.rd.Load().(time.Time); ok && !tdeadline.IsZero() {
-		timeout = time.After(time.Until(tdeadline))
+	tdeadline, _ := l.rd.Load().(time.Time)
+	timer, timeout := deadlineTimer(l.cfg.clock, tdeadline)
+	if timer != nil {
+		defer timer.Stop()
 	}
 
 	select {
 	case <-timeout:
-		return nil, errors.WithStack(errTimeout)
+		return nil, errors.WithStack(ErrTimeout)
 	case c := <-l.chAccepts:
 		return c, nil
 	case <-l.chSocketReadError:
 		return nil, l.socketReadError.Load().(error)
 	case <-l.die:
-		return nil, errors.WithStack(io.ErrClosedPipe)
+		return nil, errors.WithStack(ErrClosed)
 	}
 }
 
+// SetReadDeadline sets the deadline for future Accept calls, a zero t disables it
+func (l *Listener) SetReadDeadline(t time.Time) error {
+	l.rd.Store(t)
+	return nil
+}
+
 func (l *Listener) notifyReadError(err error) {
 	l.socketReadErrorOnce.Do(func() {
 		l.socketReadError.Store(err)
 		close(l.chSocketReadError)
+		l.kcpConn.notifyReadError(err)
 		l.sessions.Range(func(key string, sess *Session) bool {
 			sess.notifyReadError(err)
 			return true
 		})
+		l.notifyError(err)
 	})
 }
+
+// notifyError reports a listener error through the OnError hook if set, otherwise the logger
+func (l *Listener) notifyError(err error) {
+	if l.cfg.onError != nil {
+		l.cfg.onError(err)
+		return
+	}
+	l.cfg.warnLimiter.warn(l.cfg.logger, "listener error", "error", err)
+}
+
+func (l *Listener) Addr() net.Addr { return l.conn.LocalAddr() }
+
+// Close stops accepting new sessions, closes every open session and the underlying socket
+// if the listener created it
+func (l *Listener) Close() error {
+	var once bool
+	l.dieOnce.Do(func() {
+		close(l.die)
+		once = true
+	})
+	if !once {
+		return errors.WithStack(ErrClosed)
+	}
+
+	l.kcpConn.notifyReadError(errors.WithStack(ErrClosed))
+	l.kcpListener.Close()
+	// wake monitor, it clears the deadline of a caller's conn on its way out. Once it's done
+	// no datagram can create a session the loops below would miss
+	l.conn.SetReadDeadline(time.Now())
+	<-l.monitorDone
+	l.sessions.Range(func(key string, sess *Session) bool {
+		sess.Close()
+		return true
+	})
+	l.suspended.Range(func(key string, sess *Session) bool {
+		sess.Close()
+		return true
+	})
+	if l.ownConn {
+		// after the sessions, their Disconnect messages go out on it
+		return errors.WithStack(l.conn.Close())
+	}
+	return nil
+}
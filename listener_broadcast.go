@@ -0,0 +1,127 @@
+package kcp2k
+
+import "github.com/pkg/errors"
+
+// Broadcast sends data to every session that completed the handshake. It returns the number
+// of sessions sent to, a failed session doesn't stop the others. Reliable messages never wait
+// for a peer: a session whose kcp send window is full is skipped and counted in
+// Metrics.BroadcastSkipped. Unless every session was sent to, the error is a *BroadcastError
+// listing the skipped sessions, so the caller can retry them with Multicast
+func (l *Listener) Broadcast(data []byte, channel Channel) (int, error) {
+	return l.BroadcastFunc(data, channel, nil)
+}
+
+// BroadcastFunc is Broadcast limited to the sessions for which filter returns true
+func (l *Listener) BroadcastFunc(data []byte, channel Channel, filter func(*Session) bool) (int, error) {
+	m, err := l.newMulticast(data, channel)
+	if err != nil {
+		return 0, err
+	}
+	defer m.release()
+
+	l.sessionsByID.Range(func(id uint64, s *Session) bool {
+		if filter == nil || filter(s) {
+			m.send(s)
+		}
+		return true
+	})
+	return m.result()
+}
+
+// Multicast sends data to the sessions with the given ids, unknown ids are skipped
+func (l *Listener) Multicast(ids []uint64, data []byte, channel Channel) (int, error) {
+	m, err := l.newMulticast(data, channel)
+	if err != nil {
+		return 0, err
+	}
+	defer m.release()
+
+	for _, id := range ids {
+		if s, ok := l.sessionsByID.Load(id); ok {
+			m.send(s)
+		}
+	}
+	return m.result()
+}
+
+// multicast encodes a message once and sends it to many sessions. Unreliable datagrams are
+// written directly to the socket with only the cookie rewritten per session
+type multicast struct {
+	l       *Listener
+	channel Channel
+	packet  []byte
+
+	sent    int
+	skipped []uint64
+	err     error
+}
+
+func (l *Listener) newMulticast(data []byte, channel Channel) (*multicast, error) {
+	m := &multicast{l: l, channel: channel}
+	switch channel {
+	case Reliable:
+		if len(data) > ReliableMaxMessageSize {
+			return nil, errors.WithStack(ErrMessageTooLarge)
+		}
+		m.packet = append([]byte{byte(Data)}, data...)
+	case Unreliable:
+		if len(data) > UnreliableMaxMessageSize {
+			return nil, errors.WithStack(ErrMessageTooLarge)
+		}
+		m.packet = xmitBuf.Get().([]byte)[:len(data)+headerSize]
+		m.packet[0] = byte(Unreliable)
+		copy(m.packet[headerSize:], data)
+	default:
+		return nil, errors.New("invalid channel")
+	}
+	return m, nil
+}
+
+func (m *multicast) send(s *Session) {
+	select {
+	case <-s.die:
+		return
+	default:
+	}
+
+	var err error
+	switch {
+	case m.channel == Reliable && s.isQueuing():
+		_, err = s.Send(m.packet[1:], Reliable)
+	case s.isSuspended():
+		return
+	case m.channel == Reliable:
+		if _, err = s.writeNoWait(s.kcpSession(), m.packet); errors.Is(err, ErrWindowFull) {
+			m.l.metrics.broadcastSkipped.Add(1)
+			m.skipped = append(m.skipped, s.id)
+			return
+		}
+	case m.channel == Unreliable:
+		e := s.endpoint.Load()
+		copy(m.packet[1:headerSize], e.cookie)
+		var n int
+		if n, err = m.l.conn.WriteTo(m.packet, e.addr); err == nil {
+			m.l.metrics.countOut(Unreliable, n)
+		}
+	}
+	if err != nil {
+		if m.err == nil {
+			m.err = err
+		}
+		return
+	}
+	m.sent++
+}
+
+func (m *multicast) result() (int, error) {
+	if m.skipped == nil && m.err == nil {
+		return m.sent, nil
+	}
+	return m.sent, errors.WithStack(&BroadcastError{Skipped: m.skipped, Err: m.err})
+}
+
+func (m *multicast) release() {
+	if m.channel == Unreliable {
+		xmitBuf.Put(m.packet[:cap(m.packet)])
+	}
+}
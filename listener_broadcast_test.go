@@ -0,0 +1,97 @@
+package kcp2k
+
+import (
+	"fmt"
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"github.com/pkg/errors"
+	"testing"
+	"time"
+)
+
+// TestBroadcastReportsStalledPeer broadcasts to a healthy client and one whose acks are lost
+// until the stalled session's send window is full
+func TestBroadcastReportsStalledPeer(t *testing.T) {
+	n := netsim.New(1)
+	l, lconn := serve(t, n, WithLogger(discardLogger), WithPingInterval(time.Hour), WithPingTimeout(time.Hour))
+	defer lconn.Close()
+	defer l.Close()
+
+	healthy, hconn := dial(t, n, l, WithLogger(discardLogger))
+	defer hconn.Close()
+	defer healthy.Close()
+	if _, err := l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	stalled, sconn := dial(t, n, l, WithLogger(discardLogger))
+	defer sconn.Close()
+	defer stalled.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SetLink(sconn.LocalAddr(), lconn.LocalAddr(), netsim.Link{Loss: 1})
+
+	received := make(chan string, 1024)
+	go func() {
+		buf := make([]byte, mtuLimit)
+		for {
+			n, _, err := healthy.Read(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+		}
+	}()
+
+	var berr *BroadcastError
+	var sent int
+	for i := 0; ; i++ {
+		if i == 10*kcpWndRcv {
+			t.Fatal("the stalled session's send window never filled")
+		}
+		sent, err = l.Broadcast([]byte(fmt.Sprint(i)), Reliable)
+		// paced by the healthy client, whose acks keep its window open
+		select {
+		case got := <-received:
+			if got != fmt.Sprint(i) {
+				t.Fatalf("message %d is %q", i, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d never arrived, Broadcast returned %v", i, err)
+		}
+		if err != nil {
+			if !errors.As(err, &berr) {
+				t.Fatalf("Broadcast returned %v, want a BroadcastError", err)
+			}
+			break
+		}
+	}
+	if sent != 1 || len(berr.Skipped) != 1 || berr.Skipped[0] != s.ID() || berr.Err != nil || !errors.Is(err, ErrWindowFull) {
+		t.Fatalf("sent to %d sessions with %v, want 1 and session %d skipped", sent, err, s.ID())
+	}
+	if skipped := l.Metrics().BroadcastSkipped; skipped != 1 {
+		t.Fatalf("%d broadcast skips counted, want 1", skipped)
+	}
+
+	// the caller retries the skipped sessions, still stalled
+	if sent, err := l.Multicast(berr.Skipped, []byte("retry"), Reliable); sent != 0 || !errors.Is(err, ErrWindowFull) {
+		t.Fatalf("Multicast to the stalled session sent %d, %v", sent, err)
+	}
+
+	g := l.NewGroup()
+	for _, s := range l.Sessions() {
+		g.Join(s)
+	}
+	sent, err = g.Send([]byte("group"), Reliable)
+	if !errors.As(err, &berr) || sent != 1 || len(berr.Skipped) != 1 || berr.Skipped[0] != s.ID() {
+		t.Fatalf("Group.Send sent to %d sessions with %v, want 1 and session %d skipped", sent, err, s.ID())
+	}
+	if got := <-received; got != "group" {
+		t.Fatalf("healthy client got %q", got)
+	}
+
+	// unreliable messages don't use the window
+	if sent, err := l.Broadcast([]byte("unreliable"), Unreliable); sent != 2 || err != nil {
+		t.Fatalf("unreliable Broadcast sent to %d sessions, %v", sent, err)
+	}
+}
@@ -1,8 +1,8 @@
 package kcp2k
 
 import (
+	"bytes"
 	"github.com/0990/kcp2k-go/pkg/util"
-	"log/slog"
 	"net"
 )
 
@@ -10,6 +10,8 @@ const (
 	headerSize = 5
 )
 
+var zeroCookie = make([]byte, headerSize-1)
+
 type Channel byte
 
 const (
@@ -32,34 +34,151 @@ func (l *Listener) packetInput(data []byte, addr net.Addr) {
 	if s != nil {
 		err := s.CheckCookie(cookie)
 		if err != nil {
-			slog.Warn("invalid cookie", "error", err)
+			l.metrics.cookieMismatches.Add(1)
+			if !s.isAuthenticated() {
+				s.handshakeFailed(handshakeError(HandshakeCookieMismatch, err))
+				return
+			}
+			l.cfg.warnLimiter.warn(s.logger(), "invalid cookie", "error", err)
 			return
 		}
+		s.lastReceiveTime.Store(l.cfg.clock.Now().UnixNano())
+	} else if channel == Reliable && !l.admit(addr) {
+		return
 	}
 
+	l.metrics.countIn(channel, len(data))
+
 	switch channel {
 	case Reliable:
-		kcpData := data[headerSize:]
-		l.kcpConn.packetInput(kcpData, addr)
-
 		if s == nil {
-			s := newSession(util.RandBytes(4), l, l.conn, false, addr)
-			l.sessions.Store(addrStr, s)
-
-			s.WaitAcceptKCP(func(err error) {
-				if err != nil {
-					s.Close()
-					slog.Warn("handshake failed", "error", err)
-					return
-				}
-			})
+			if !isHandshakeStart(cookie, data[headerSize:]) {
+				l.metrics.invalidDatagrams.Add(1)
+				return
+			}
+			s = l.newPendingSession(addrStr, addr)
+			if s == nil {
+				return
+			}
 		}
+
+		kcpData := data[headerSize:]
+		l.kcpConn.packetInput(kcpData, addr)
 	case Unreliable:
 		if s != nil {
 			s.onRawInputUnreliable(data[headerSize:])
 		}
 		return
 	default:
+		l.metrics.invalidDatagrams.Add(1)
+	}
+}
 
+// isHandshakeStart reports whether a datagram from an unknown address may open a session:
+// a new client hasn't learned a cookie yet and its first kcp segment pushes Hello.
+// Anything else would only create a pending session that times out
+func isHandshakeStart(cookie, kcpData []byte) bool {
+	return bytes.Equal(cookie, zeroCookie) && len(kcpData) >= kcpOverhead && kcpData[4] == kcpCmdPush
+}
+
+// newPendingSession creates the session for an unknown address, or returns nil if a
+// connection limit is hit. The protocol has no way to tell a peer it was rejected before
+// the kcp handshake, so rejected peers simply time out
+func (l *Listener) newPendingSession(addrStr string, addr net.Addr) *Session {
+	if max := l.cfg.maxSessions; max > 0 && l.sessionCount.Load() >= int64(max) {
+		l.metrics.limitRejections[limitMaxSessions].Add(1)
+		return nil
+	}
+	if max := l.cfg.maxPendingHandshakes; max > 0 && l.pendingHandshakes.Load() >= int64(max) {
+		l.metrics.limitRejections[limitMaxPendingHandshakes].Add(1)
+		return nil
+	}
+	if max := l.cfg.maxSessionsPerIP; max > 0 {
+		ip := addrPortOf(addr).Addr().Unmap()
+		l.ipMu.Lock()
+		if l.ipSessions[ip] >= max {
+			l.ipMu.Unlock()
+			l.metrics.limitRejections[limitMaxSessionsPerIP].Add(1)
+			return nil
+		}
+		l.ipSessions[ip]++
+		l.ipMu.Unlock()
+	}
+
+	l.sessionCount.Add(1)
+	l.pendingHandshakes.Add(1)
+	s := newSession(util.RandBytes(4), l, l.conn, false, addr, l.cfg)
+	s.id = l.nextID.Add(1)
+	l.sessions.Store(addrStr, s)
+
+	s.WaitAcceptKCP(func(err error) {
+		if err != nil {
+			s.handshakeFailed(err)
+		}
+	})
+	return s
+}
+
+// removeSession drops s from the session table and releases its slot in the connection limits.
+// It is called once per session, from Session.close or, for the pending session a resume
+// takes over, from Session.resume
+func (l *Listener) removeSession(s *Session, state Kcp2kState) {
+	if s.resumeToken != nil {
+		l.resumable.CompareAndDelete(string(s.resumeToken), s)
+	}
+	if state == Suspended {
+		// address and IP slot were released on suspend
+		l.suspended.CompareAndDelete(string(s.resumeToken), s)
+		s.resumeTimer.Stop()
+		if l.sessionsByID.CompareAndDelete(s.id, s) {
+			l.sessionCount.Add(-1)
+		}
+		return
+	}
+	if !l.sessions.CompareAndDelete(s.RemoteAddr().String(), s) {
+		return
+	}
+	l.sessionsByID.CompareAndDelete(s.id, s)
+
+	l.sessionCount.Add(-1)
+	if state == Connected {
+		l.pendingHandshakes.Add(-1)
+	}
+	l.releaseIP(s.RemoteAddr())
+}
+
+func (l *Listener) releaseIP(addr net.Addr) {
+	if l.cfg.maxSessionsPerIP <= 0 {
+		return
+	}
+	ip := addrPortOf(addr).Addr().Unmap()
+	l.ipMu.Lock()
+	if l.ipSessions[ip]--; l.ipSessions[ip] <= 0 {
+		delete(l.ipSessions, ip)
+	}
+	l.ipMu.Unlock()
+}
+
+// holdIP counts a session against its IP without checking the limit, for a resumed session
+// taking over the slot its new connection just released
+func (l *Listener) holdIP(addr net.Addr) {
+	if l.cfg.maxSessionsPerIP <= 0 {
+		return
+	}
+	ip := addrPortOf(addr).Addr().Unmap()
+	l.ipMu.Lock()
+	l.ipSessions[ip]++
+	l.ipMu.Unlock()
+}
+
+// admit runs the AdmitFunc before an unknown address gets a session
+func (l *Listener) admit(addr net.Addr) bool {
+	if l.cfg.admit == nil {
+		return true
+	}
+	if !l.cfg.admit(addrPortOf(addr)) {
+		l.metrics.admissionsRejected.Add(1)
+		return false
 	}
+	return true
 }
@@ -0,0 +1,79 @@
+package kcp2k
+
+import (
+	"encoding/binary"
+	"github.com/0990/kcp2k-go/pkg/leakcheck"
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	fuzzMaxSessions          = 6
+	fuzzMaxPendingHandshakes = 4
+)
+
+func FuzzListenerPacketInput(f *testing.F) {
+	hello := append([]byte{byte(Reliable), 0, 0, 0, 0}, kcpSegment(1, kcpCmdPush, 0, []byte{byte(Hello)})...)
+	tooLong := append([]byte(nil), hello...)
+	binary.LittleEndian.PutUint32(tooLong[headerSize+20:], 0xffffffff)
+	for _, seed := range [][]byte{
+		hello,
+		tooLong,
+		append([]byte{byte(Reliable), 1, 2, 3, 4}, hello[headerSize:]...),        // a cookie before the handshake
+		append([]byte{byte(Reliable), 0, 0, 0, 0}, kcpSegment(1, 82, 0, nil)...), // an ack
+		append([]byte{byte(Reliable), 0, 0, 0, 0}, kcpSegment(1, kcpCmdPush, 0, []byte{byte(Data)})...),
+		{byte(Unreliable), 0, 0, 0, 0, 'h', 'i'},
+		{byte(Invalid), 0, 0, 0, 0},
+		{3, 0, 0, 0, 0, 0},
+		{byte(Reliable), 0},
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		snap := leakcheck.Take()
+		conn, err := netsim.New(1).Listen("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		l, err := ServeConn(conn, WithLogger(discardLogger), WithMaxSessions(fuzzMaxSessions),
+			WithMaxPendingHandshakes(fuzzMaxPendingHandshakes), WithMaxSessionsPerIP(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 16 peers on 8 IPs, each sending the datagram twice
+		for i := 0; i < 32; i++ {
+			addr := &net.UDPAddr{IP: net.IPv4(203, 0, 113, byte(i%8+1)), Port: 1000 + i%16/8}
+			l.packetInput(data, addr)
+			checkListenerBounds(t, l)
+		}
+		if len(data) < headerSize || !isHandshakeStart(data[1:headerSize], data[headerSize:]) {
+			if n := l.sessionCount.Load(); n != 0 {
+				t.Fatalf("%d sessions from datagrams that don't start a handshake", n)
+			}
+		}
+		time.Sleep(10 * time.Millisecond) // let the handshakes run
+		checkListenerBounds(t, l)
+
+		l.Close()
+		if err := snap.Check(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func checkListenerBounds(t *testing.T, l *Listener) {
+	t.Helper()
+	if n := l.sessionCount.Load(); n < 0 || n > fuzzMaxSessions {
+		t.Fatalf("%d sessions, the limit is %d", n, fuzzMaxSessions)
+	}
+	if n := l.SessionCount(); n < 0 || n > fuzzMaxSessions {
+		t.Fatalf("SessionCount %d, the limit is %d", n, fuzzMaxSessions)
+	}
+	if n := l.pendingHandshakes.Load(); n < 0 || n > fuzzMaxPendingHandshakes {
+		t.Fatalf("%d pending handshakes, the limit is %d", n, fuzzMaxPendingHandshakes)
+	}
+}
@@ -0,0 +1,37 @@
+package kcp2k
+
+import "github.com/pkg/errors"
+
+// Session returns the connected session with the given id
+func (l *Listener) Session(id uint64) (*Session, bool) {
+	return l.sessionsByID.Load(id)
+}
+
+// Sessions returns a snapshot of the sessions that completed the handshake
+func (l *Listener) Sessions() []*Session {
+	sessions := make([]*Session, 0, l.SessionCount())
+	l.sessionsByID.Range(func(id uint64, s *Session) bool {
+		sessions = append(sessions, s)
+		return true
+	})
+	return sessions
+}
+
+// SessionCount returns the number of sessions that completed the handshake
+func (l *Listener) SessionCount() int {
+	return int(l.metrics.activeSessions.Load())
+}
+
+// Kick sends Disconnect to the session with the given id and closes it.
+// Read and Send on the kicked session return a DisconnectError wrapping reason
+func (l *Listener) Kick(id uint64, reason error) error {
+	s, ok := l.sessionsByID.Load(id)
+	if !ok {
+		return errors.Errorf("no session %d", id)
+	}
+	if reason == nil {
+		reason = ErrClosed
+	}
+	s.close(reasonKicked, errors.WithStack(&DisconnectError{Code: ConnectionClosed, Err: reason}))
+	return nil
+}
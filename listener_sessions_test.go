@@ -0,0 +1,102 @@
+package kcp2k
+
+import (
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"github.com/pkg/errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSessionIDsNeverRepeat(t *testing.T) {
+	n := netsim.New(1)
+	l, lconn := serve(t, n, WithLogger(discardLogger))
+	defer lconn.Close()
+	defer l.Close()
+
+	seen := make(map[uint64]bool)
+	accept := func() *Session {
+		t.Helper()
+		c, cconn := dial(t, n, l, WithLogger(discardLogger))
+		t.Cleanup(func() { cconn.Close() })
+		t.Cleanup(c.Close)
+		if c.ID() != 0 {
+			t.Fatalf("dialled session has ID %d", c.ID())
+		}
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.ID() == 0 || seen[s.ID()] {
+			t.Fatalf("ID %d repeats or is 0", s.ID())
+		}
+		seen[s.ID()] = true
+		return s
+	}
+
+	for i := 0; i < 10; i++ {
+		s := accept()
+		if i%2 == 0 {
+			s.Close()
+		}
+	}
+	// a uint32 counter would wrap to 0 here
+	l.nextID.Store(math.MaxUint32)
+	if s := accept(); s.ID() != math.MaxUint32+1 {
+		t.Fatalf("ID %d after %d", s.ID(), uint64(math.MaxUint32))
+	}
+}
+
+func TestSessionLookupAndKick(t *testing.T) {
+	n := netsim.New(1)
+	l, lconn := serve(t, n, WithLogger(discardLogger))
+	defer lconn.Close()
+	defer l.Close()
+	c, cconn := dial(t, n, l, WithLogger(discardLogger))
+	defer cconn.Close()
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, ok := l.Session(s.ID()); !ok || got != s {
+		t.Fatalf("Session(%d) = %v, %t", s.ID(), got, ok)
+	}
+	if _, ok := l.Session(s.ID() + 1); ok {
+		t.Fatal("Session found an unknown id")
+	}
+	if sessions := l.Sessions(); len(sessions) != 1 || sessions[0] != s {
+		t.Fatalf("Sessions() = %v", sessions)
+	}
+
+	if err := l.Kick(s.ID()+1, nil); err == nil {
+		t.Fatal("Kick of an unknown id succeeded")
+	}
+	reason := errors.New("cheating")
+	if err := l.Kick(s.ID(), reason); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server side reports the reason, the client the Disconnect it received
+	_, _, err = s.Read(make([]byte, mtuLimit))
+	var derr *DisconnectError
+	if !errors.As(err, &derr) || derr.Code != ConnectionClosed || !errors.Is(err, reason) {
+		t.Fatalf("kicked session's Read returned %v, want a DisconnectError wrapping the reason", err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = c.Read(make([]byte, mtuLimit))
+	if !errors.As(err, &derr) || derr.Code != ConnectionClosed {
+		t.Fatalf("client's Read returned %v, want the peer's Disconnect", err)
+	}
+
+	if _, ok := l.Session(s.ID()); ok {
+		t.Fatal("kicked session still found")
+	}
+	if err := l.Kick(s.ID(), nil); err == nil {
+		t.Fatal("Kick of a kicked session succeeded")
+	}
+	if m := l.Metrics(); m.Disconnects[reasonKicked.String()] != 1 || m.ActiveSessions != 0 {
+		t.Fatalf("after Kick: %+v", m)
+	}
+}
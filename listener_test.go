@@ -0,0 +1,288 @@
+package kcp2k
+
+import (
+	"encoding/binary"
+	"github.com/0990/kcp-go"
+	"github.com/0990/kcp2k-go/pkg/leakcheck"
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"github.com/pkg/errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve runs a Listener on a new conn of n
+func serve(t *testing.T, n *netsim.Network, opts ...Option) (*Listener, *netsim.Conn) {
+	t.Helper()
+	conn, err := n.Listen("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ServeConn(conn, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, conn
+}
+
+// dial handshakes with l from a new conn of n
+func dial(t *testing.T, n *netsim.Network, l *Listener, opts ...Option) (*Session, *netsim.Conn) {
+	t.Helper()
+	conn, err := n.Listen("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := DialConn(conn, l.Addr(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, conn
+}
+
+// bareSession is an authenticated session on conn without a kcp session, messages are fed to
+// it directly. It sends to peer
+func bareSession(conn, peer net.PacketConn) *Session {
+	s := newSession([]byte{1, 2, 3, 4}, nil, conn, false, peer.LocalAddr(), newConfig([]Option{WithLogger(discardLogger)}))
+	s.SetState(Authenticated)
+	return s
+}
+
+// kcpSegment is a kcp segment as kcp-go puts it on the wire, without the kcp2k header
+func kcpSegment(conv uint32, cmd byte, sn uint32, payload []byte) []byte {
+	b := make([]byte, kcpOverhead+len(payload))
+	binary.LittleEndian.PutUint32(b, conv)
+	b[4] = cmd
+	binary.LittleEndian.PutUint16(b[6:], kcpWndRcv)
+	binary.LittleEndian.PutUint32(b[12:], sn)
+	binary.LittleEndian.PutUint32(b[20:], uint32(len(payload)))
+	copy(b[kcpOverhead:], payload)
+	return b
+}
+
+func acceptErr(t *testing.T, l *Listener) error {
+	t.Helper()
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	s, err := l.Accept()
+	if err == nil {
+		t.Fatalf("Accept returned session %d, want an error", s.ID())
+	}
+	if errors.Is(err, ErrTimeout) {
+		t.Fatal("Accept timed out")
+	}
+	return err
+}
+
+func waitError(t *testing.T, errs <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnError wasn't called")
+		return nil
+	}
+}
+
+func TestAcceptKCPErrorReachesAcceptAndOnError(t *testing.T) {
+	errs := make(chan error, 4)
+	l, _ := serve(t, netsim.New(1), WithOnError(func(err error) { errs <- err }))
+	defer l.Close()
+
+	// kcp-go's listener fails while ours is still open
+	l.kcpListener.Close()
+
+	err := acceptErr(t, l)
+	if got := waitError(t, errs); got != err {
+		t.Fatalf("OnError got %v, Accept returned %v", got, err)
+	}
+}
+
+func TestSocketErrorReachesAcceptAndOnError(t *testing.T) {
+	errs := make(chan error, 4)
+	l, conn := serve(t, netsim.New(1), WithOnError(func(err error) { errs <- err }))
+	defer l.Close()
+
+	conn.Close()
+
+	err := acceptErr(t, l)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Accept returned %v, want the socket's net.ErrClosed", err)
+	}
+	if got := waitError(t, errs); got != err {
+		t.Fatalf("OnError got %v, Accept returned %v", got, err)
+	}
+}
+
+func TestHandleNewKcpErrorReachesOnError(t *testing.T) {
+	errs := make(chan error, 4)
+	l, _ := serve(t, netsim.New(1), WithOnError(func(err error) { errs <- err }))
+	defer l.Close()
+
+	// a kcp session for an address the listener has no kcp2k session for
+	addr := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 1}
+	l.kcpConn.packetInput(kcpSegment(1, kcpCmdPush, 0, []byte{byte(Hello)}), addr)
+
+	err := waitError(t, errs)
+	if !strings.Contains(err.Error(), "handleNewKcp "+addr.String()) {
+		t.Fatalf("OnError got %v, want the handleNewKcp error", err)
+	}
+	if n := l.SessionCount(); n != 0 {
+		t.Fatalf("%d sessions, want 0", n)
+	}
+}
+
+func TestCloseStopsAcceptLoop(t *testing.T) {
+	snap := leakcheck.Take()
+	errs := make(chan error, 4)
+	l, conn := serve(t, netsim.New(1), WithOnError(func(err error) { errs <- err }))
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-accepted:
+		if !errors.Is(err, ErrClosed) {
+			t.Fatalf("Accept returned %v, want ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept still blocked after Close")
+	}
+	if err := snap.Check(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("OnError called on Close: %v", err)
+	default:
+	}
+	conn.Close()
+}
+
+func TestDialAcceptCloseCyclesLeaveNothingRunning(t *testing.T) {
+	snap := leakcheck.Take()
+	n := netsim.New(1)
+	lconn, _ := n.Listen("")
+	cconn, _ := n.Listen("")
+	defer lconn.Close()
+	defer cconn.Close()
+
+	for i := 0; i < 30; i++ {
+		// the same conns every cycle, Close must leave them free to reuse
+		l, err := ServeConn(lconn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := DialConn(cconn, lconn.LocalAddr())
+		if err != nil {
+			t.Fatalf("cycle %d: %v", i, err)
+		}
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatalf("cycle %d: %v", i, err)
+		}
+		send(t, c, "ping")
+		readString(t, s)
+		send(t, s, "pong")
+		readString(t, c)
+
+		switch i % 3 {
+		case 0:
+			c.Close()
+			s.Close()
+		case 1:
+			s.Close()
+			c.Close()
+		case 2:
+			// the listener closes its sessions
+			l.Close()
+			c.Close()
+		}
+		l.Close()
+	}
+	if err := snap.Check(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// no read deadline left behind
+	if _, err := lconn.WriteTo([]byte("x"), cconn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cconn.ReadFrom(make([]byte, mtuLimit)); err != nil {
+		t.Fatalf("caller's conn unusable after Close: %v", err)
+	}
+}
+
+// extraKcpSession is a kcp session for addr that the listener didn't create, as when kcp-go
+// creates another one for a known address
+func extraKcpSession(t *testing.T, addr net.Addr) *kcp.UDPSession {
+	t.Helper()
+	conn, _ := netsim.Pipe(1, netsim.Link{}, netsim.Link{})
+	t.Cleanup(func() { conn.Close() })
+	sess, err := kcp.NewConn3(1, addr, nil, 0, 0, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sess.Close() })
+	return sess
+}
+
+func TestSecondKcpSessionLeavesEstablishedSession(t *testing.T) {
+	errs := make(chan error, 4)
+	failed := make(chan HandshakeFailReason, 4)
+	n := netsim.New(1)
+	l, lconn := serve(t, n, WithLogger(discardLogger), WithOnError(func(err error) { errs <- err }),
+		WithOnHandshakeFailed(func(addr net.Addr, reason HandshakeFailReason) { failed <- reason }))
+	defer lconn.Close()
+	defer l.Close()
+	c, cconn := dial(t, n, l, WithLogger(discardLogger))
+	defer cconn.Close()
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extra := extraKcpSession(t, s.RemoteAddr())
+	if err := l.handleNewKcp(extra); err == nil {
+		t.Fatal("no error for a second kcp session")
+	}
+	if _, err := extra.Write([]byte{byte(Ping)}); err == nil {
+		t.Fatal("the second kcp session is still open")
+	}
+	if s.dead() || s.kcpSession() == extra {
+		t.Fatal("the established session was torn down or lost its kcp session")
+	}
+	send(t, c, "still there")
+	if got := readString(t, s); got != "still there" {
+		t.Fatalf("got %q", got)
+	}
+	if m := l.Metrics(); m.HandshakesRejected != 0 || m.ActiveSessions != 1 {
+		t.Fatalf("after the second kcp session: %+v", m)
+	}
+	select {
+	case reason := <-failed:
+		t.Fatalf("OnHandshakeFailed called with %s", reason)
+	default:
+	}
+
+	// while the handshake is pending it's a collision
+	addr := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 1}
+	p := l.newPendingSession(addr.String(), addr)
+	p.SetKcpSession(extraKcpSession(t, addr))
+	if err := l.handleNewKcp(extraKcpSession(t, addr)); err != nil {
+		t.Fatal(err)
+	}
+	if reason := <-failed; reason != HandshakeCollision || !p.dead() {
+		t.Fatalf("OnHandshakeFailed got %s, want collision", reason)
+	}
+	if m := l.Metrics(); m.HandshakesRejected != 1 || m.PendingHandshakes != 0 {
+		t.Fatalf("after the collision: %+v", m)
+	}
+}
@@ -0,0 +1,75 @@
+package kcp2k
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// logLimiter 限制每种per-packet告警的输出频率，防止恶意流量刷爆日志
+type logLimiter struct {
+	burst    int
+	interval time.Duration
+	clock    Clock
+
+	mu      sync.Mutex
+	windows map[string]*logWindow
+}
+
+type logWindow struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+func newLogLimiter(burst int, interval time.Duration, clock Clock) *logLimiter {
+	return &logLimiter{
+		burst:    burst,
+		interval: interval,
+		clock:    clock,
+		windows:  make(map[string]*logWindow),
+	}
+}
+
+// allow reports whether a warning with msg may be logged now, and how many were
+// suppressed in the previous window
+func (r *logLimiter) allow(msg string) (ok bool, suppressed int) {
+	if r.burst <= 0 {
+		return true, 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	w := r.windows[msg]
+	if w == nil {
+		w = &logWindow{start: now}
+		r.windows[msg] = w
+	}
+	if now.Sub(w.start) >= r.interval {
+		suppressed = w.suppressed
+		w.start = now
+		w.count = 0
+		w.suppressed = 0
+	}
+	if w.count >= r.burst {
+		w.suppressed++
+		return false, 0
+	}
+	w.count++
+	return true, suppressed
+}
+
+// warn logs a per-packet warning through the rate limiter
+func (r *logLimiter) warn(logger *slog.Logger, msg string, args ...any) {
+	ok, suppressed := r.allow(msg)
+	if !ok || !logger.Enabled(context.Background(), slog.LevelWarn) {
+		return
+	}
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	logger.Warn(msg, args...)
+}
@@ -0,0 +1,322 @@
+package kcp2k
+
+import (
+	"fmt"
+	"github.com/0990/kcp-go"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+type disconnectReason byte
+
+const (
+	reasonClosed    disconnectReason = iota // closed locally
+	reasonRemote                            // peer sent Disconnect
+	reasonTimeout                           // ping timeout
+	reasonIdle                              // idle timeout
+	reasonProtocol                          // peer violated the protocol
+	reasonRateLimit                         // peer exceeded its inbound rate limit
+	reasonKicked                            // closed by Listener.Kick
+	reasonCount
+)
+
+func (r disconnectReason) String() string {
+	switch r {
+	case reasonClosed:
+		return "closed"
+	case reasonRemote:
+		return "remote"
+	case reasonTimeout:
+		return "timeout"
+	case reasonIdle:
+		return "idle"
+	case reasonProtocol:
+		return "protocol"
+	case reasonRateLimit:
+		return "rate_limit"
+	case reasonKicked:
+		return "kicked"
+	default:
+		return "unknown"
+	}
+}
+
+const channelCount = 3
+
+type connectionLimit byte
+
+const (
+	limitMaxSessions connectionLimit = iota
+	limitMaxSessionsPerIP
+	limitMaxPendingHandshakes
+	limitCount
+)
+
+func (c connectionLimit) String() string {
+	switch c {
+	case limitMaxSessions:
+		return "max_sessions"
+	case limitMaxSessionsPerIP:
+		return "max_sessions_per_ip"
+	case limitMaxPendingHandshakes:
+		return "max_pending_handshakes"
+	default:
+		return "unknown"
+	}
+}
+
+func (c Channel) String() string {
+	switch c {
+	case Reliable:
+		return "reliable"
+	case Unreliable:
+		return "unreliable"
+	default:
+		return "invalid"
+	}
+}
+
+type listenerMetrics struct {
+	activeSessions     atomic.Int64
+	handshakesAccepted atomic.Uint64
+	handshakesRejected atomic.Uint64
+	cookieMismatches   atomic.Uint64
+	admissionsRejected atomic.Uint64
+	queueDrops         atomic.Uint64
+	invalidDatagrams   atomic.Uint64
+	suspensions        atomic.Uint64
+	resumptions        atomic.Uint64
+	broadcastSkipped   atomic.Uint64
+
+	disconnects     [reasonCount]atomic.Uint64
+	limitRejections [limitCount]atomic.Uint64
+
+	datagramsIn  [channelCount]atomic.Uint64
+	bytesIn      [channelCount]atomic.Uint64
+	datagramsOut [channelCount]atomic.Uint64
+	bytesOut     [channelCount]atomic.Uint64
+	rateLimited  [channelCount]atomic.Uint64
+}
+
+func (m *listenerMetrics) countIn(channel Channel, n int) {
+	if int(channel) >= channelCount {
+		return
+	}
+	m.datagramsIn[channel].Add(1)
+	m.bytesIn[channel].Add(uint64(n))
+}
+
+func (m *listenerMetrics) countOut(channel Channel, n int) {
+	if int(channel) >= channelCount {
+		return
+	}
+	m.datagramsOut[channel].Add(1)
+	m.bytesOut[channel].Add(uint64(n))
+}
+
+// ChannelMetrics counts datagrams and bytes on one channel, kcp2k header included
+type ChannelMetrics struct {
+	DatagramsIn  uint64
+	BytesIn      uint64
+	DatagramsOut uint64
+	BytesOut     uint64
+	// RateLimited counts inbound messages over a session's RateLimit
+	RateLimited uint64
+}
+
+// Metrics is a point-in-time snapshot of a Listener's counters
+type Metrics struct {
+	ActiveSessions     int64
+	PendingHandshakes  int64
+	HandshakesAccepted uint64
+	HandshakesRejected uint64
+	CookieMismatches   uint64
+	// AdmissionsRejected counts handshake datagrams dropped by the AdmitFunc
+	AdmissionsRejected uint64
+	// QueueDrops counts inbound unreliable messages dropped because the read queue was full
+	QueueDrops uint64
+	// InvalidDatagrams counts datagrams dropped for an unknown channel, or from an unknown
+	// address without the shape of a handshake
+	InvalidDatagrams uint64
+	// Suspensions counts sessions kept for resumption after a ping timeout, Resumptions those resumed
+	Suspensions uint64
+	Resumptions uint64
+	// BroadcastSkipped counts reliable Broadcast, Multicast and Group.Send messages not sent
+	// to a session because its kcp send window was full
+	BroadcastSkipped uint64
+	// Disconnects is keyed by reason: closed, remote, timeout, idle, protocol, rate_limit, kicked
+	Disconnects map[string]uint64
+	// Limits holds the configured connection limits, 0 meaning unlimited, and LimitRejections
+	// the new peers turned away by each. Both are keyed by max_sessions, max_sessions_per_ip
+	// and max_pending_handshakes
+	Limits          map[string]int
+	LimitRejections map[string]uint64
+
+	Reliable   ChannelMetrics
+	Unreliable ChannelMetrics
+
+	// Retransmits is taken from kcp-go's process-wide counters and is shared by every Listener
+	Retransmits uint64
+}
+
+func (l *Listener) Metrics() Metrics {
+	m := &l.metrics
+	snap := Metrics{
+		ActiveSessions:     m.activeSessions.Load(),
+		PendingHandshakes:  l.pendingHandshakes.Load(),
+		HandshakesAccepted: m.handshakesAccepted.Load(),
+		HandshakesRejected: m.handshakesRejected.Load(),
+		CookieMismatches:   m.cookieMismatches.Load(),
+		AdmissionsRejected: m.admissionsRejected.Load(),
+		QueueDrops:         m.queueDrops.Load(),
+		InvalidDatagrams:   m.invalidDatagrams.Load(),
+		Suspensions:        m.suspensions.Load(),
+		Resumptions:        m.resumptions.Load(),
+		BroadcastSkipped:   m.broadcastSkipped.Load(),
+		Disconnects:        make(map[string]uint64, reasonCount),
+		Limits: map[string]int{
+			limitMaxSessions.String():          l.cfg.maxSessions,
+			limitMaxSessionsPerIP.String():     l.cfg.maxSessionsPerIP,
+			limitMaxPendingHandshakes.String(): l.cfg.maxPendingHandshakes,
+		},
+		LimitRejections: make(map[string]uint64, limitCount),
+	}
+	for r := disconnectReason(0); r < reasonCount; r++ {
+		snap.Disconnects[r.String()] = m.disconnects[r].Load()
+	}
+	for c := connectionLimit(0); c < limitCount; c++ {
+		snap.LimitRejections[c.String()] = m.limitRejections[c].Load()
+	}
+
+	channelSnapshot := func(c Channel) ChannelMetrics {
+		return ChannelMetrics{
+			DatagramsIn:  m.datagramsIn[c].Load(),
+			BytesIn:      m.bytesIn[c].Load(),
+			DatagramsOut: m.datagramsOut[c].Load(),
+			BytesOut:     m.bytesOut[c].Load(),
+			RateLimited:  m.rateLimited[c].Load(),
+		}
+	}
+	snap.Reliable = channelSnapshot(Reliable)
+	snap.Unreliable = channelSnapshot(Unreliable)
+
+	snmp := kcp.DefaultSnmp.Copy()
+	snap.Retransmits = snmp.RetransSegs
+
+	return snap
+}
+
+// WritePrometheus writes the snapshot in the Prometheus text exposition format
+func (m Metrics) WritePrometheus(w io.Writer) error {
+	pw := &promWriter{w: w}
+
+	pw.metric("kcp2k_active_sessions", "gauge", "Sessions that completed the handshake and are still open.")
+	pw.sample("kcp2k_active_sessions", "", m.ActiveSessions)
+
+	pw.metric("kcp2k_pending_handshakes", "gauge", "Sessions that haven't completed the handshake yet.")
+	pw.sample("kcp2k_pending_handshakes", "", m.PendingHandshakes)
+
+	pw.metric("kcp2k_handshakes_accepted_total", "counter", "Handshakes completed successfully.")
+	pw.sample("kcp2k_handshakes_accepted_total", "", m.HandshakesAccepted)
+
+	pw.metric("kcp2k_handshakes_rejected_total", "counter", "Handshakes that failed or timed out.")
+	pw.sample("kcp2k_handshakes_rejected_total", "", m.HandshakesRejected)
+
+	pw.metric("kcp2k_cookie_mismatches_total", "counter", "Datagrams dropped because of an invalid cookie.")
+	pw.sample("kcp2k_cookie_mismatches_total", "", m.CookieMismatches)
+
+	pw.metric("kcp2k_admissions_rejected_total", "counter", "Handshake datagrams dropped by the admission hook.")
+	pw.sample("kcp2k_admissions_rejected_total", "", m.AdmissionsRejected)
+
+	pw.metric("kcp2k_queue_drops_total", "counter", "Inbound messages dropped because the read queue was full.")
+	pw.sample("kcp2k_queue_drops_total", "", m.QueueDrops)
+
+	pw.metric("kcp2k_invalid_datagrams_total", "counter", "Malformed datagrams dropped.")
+	pw.sample("kcp2k_invalid_datagrams_total", "", m.InvalidDatagrams)
+
+	pw.metric("kcp2k_suspensions_total", "counter", "Sessions suspended for resumption after a ping timeout.")
+	pw.sample("kcp2k_suspensions_total", "", m.Suspensions)
+
+	pw.metric("kcp2k_resumptions_total", "counter", "Suspended sessions resumed by their client.")
+	pw.sample("kcp2k_resumptions_total", "", m.Resumptions)
+
+	pw.metric("kcp2k_broadcast_skipped_total", "counter", "Reliable broadcast messages skipped for a session with a full send window.")
+	pw.sample("kcp2k_broadcast_skipped_total", "", m.BroadcastSkipped)
+
+	pw.metric("kcp2k_disconnects_total", "counter", "Sessions closed after the handshake, by reason.")
+	for r := disconnectReason(0); r < reasonCount; r++ {
+		pw.sample("kcp2k_disconnects_total", fmt.Sprintf(`reason="%s"`, r), m.Disconnects[r.String()])
+	}
+
+	pw.metric("kcp2k_connection_limit", "gauge", "Configured connection limits, 0 means unlimited.")
+	for c := connectionLimit(0); c < limitCount; c++ {
+		pw.sample("kcp2k_connection_limit", fmt.Sprintf(`limit="%s"`, c), m.Limits[c.String()])
+	}
+	pw.metric("kcp2k_limit_rejections_total", "counter", "New peers rejected because a connection limit was reached.")
+	for c := connectionLimit(0); c < limitCount; c++ {
+		pw.sample("kcp2k_limit_rejections_total", fmt.Sprintf(`limit="%s"`, c), m.LimitRejections[c.String()])
+	}
+
+	channels := []struct {
+		c Channel
+		m ChannelMetrics
+	}{{Reliable, m.Reliable}, {Unreliable, m.Unreliable}}
+
+	pw.metric("kcp2k_datagrams_received_total", "counter", "Datagrams received, by channel.")
+	for _, ch := range channels {
+		pw.sample("kcp2k_datagrams_received_total", fmt.Sprintf(`channel="%s"`, ch.c), ch.m.DatagramsIn)
+	}
+	pw.metric("kcp2k_bytes_received_total", "counter", "Bytes received including the kcp2k header, by channel.")
+	for _, ch := range channels {
+		pw.sample("kcp2k_bytes_received_total", fmt.Sprintf(`channel="%s"`, ch.c), ch.m.BytesIn)
+	}
+	pw.metric("kcp2k_datagrams_sent_total", "counter", "Datagrams sent, by channel.")
+	for _, ch := range channels {
+		pw.sample("kcp2k_datagrams_sent_total", fmt.Sprintf(`channel="%s"`, ch.c), ch.m.DatagramsOut)
+	}
+	pw.metric("kcp2k_bytes_sent_total", "counter", "Bytes sent including the kcp2k header, by channel.")
+	for _, ch := range channels {
+		pw.sample("kcp2k_bytes_sent_total", fmt.Sprintf(`channel="%s"`, ch.c), ch.m.BytesOut)
+	}
+
+	pw.metric("kcp2k_rate_limited_total", "counter", "Inbound messages over a session's rate limit, by channel.")
+	for _, ch := range channels {
+		pw.sample("kcp2k_rate_limited_total", fmt.Sprintf(`channel="%s"`, ch.c), ch.m.RateLimited)
+	}
+
+	pw.metric("kcp2k_retransmits_total", "counter", "KCP segments retransmitted, process-wide.")
+	pw.sample("kcp2k_retransmits_total", "", m.Retransmits)
+
+	return pw.err
+}
+
+type promWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *promWriter) metric(name, typ, help string) {
+	if p.err != nil {
+		return
+	}
+	_, p.err = fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (p *promWriter) sample(name, labels string, value any) {
+	if p.err != nil {
+		return
+	}
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	_, p.err = fmt.Fprintf(p.w, "%s %d\n", name, value)
+}
+
+// MetricsHandler serves the listener's metrics in the Prometheus text format
+func (l *Listener) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		l.Metrics().WritePrometheus(w)
+	})
+}
@@ -0,0 +1,87 @@
+package kcp2k
+
+import (
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsAfterDialSendClose(t *testing.T) {
+	n := netsim.New(1)
+	l, lconn := serve(t, n, WithLogger(discardLogger))
+	defer lconn.Close()
+	defer l.Close()
+	c, cconn := dial(t, n, l, WithLogger(discardLogger))
+	defer cconn.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := l.Metrics()
+	if m.ActiveSessions != 1 || m.PendingHandshakes != 0 || m.HandshakesAccepted != 1 || m.HandshakesRejected != 0 {
+		t.Fatalf("after the handshake: %+v", m)
+	}
+
+	msg := []byte("unreliable")
+	for i := 0; i < 3; i++ {
+		if _, err := c.Send(msg, Unreliable); err != nil {
+			t.Fatal(err)
+		}
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := s.Read(make([]byte, mtuLimit)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := s.Send(msg, Unreliable); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := c.Read(make([]byte, mtuLimit)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send(t, c, "reliable")
+	readString(t, s)
+
+	m = l.Metrics()
+	datagram := uint64(headerSize + len(msg))
+	if got := m.Unreliable; got.DatagramsIn != 3 || got.BytesIn != 3*datagram || got.DatagramsOut != 2 || got.BytesOut != 2*datagram {
+		t.Fatalf("unreliable %+v, want 3 datagrams of %d bytes in and 2 out", got, datagram)
+	}
+	// kcp adds acks and its own headers, at least Hello and the message came in and Hello went out
+	if got := m.Reliable; got.DatagramsIn < 2 || got.BytesIn < 2*(headerSize+kcpOverhead) || got.DatagramsOut < 1 {
+		t.Fatalf("reliable %+v", got)
+	}
+
+	c.Close()
+	eventually(t, "the server session to close", func() bool { return l.Metrics().ActiveSessions == 0 })
+	m = l.Metrics()
+	for reason, count := range m.Disconnects {
+		var want uint64
+		if reason == reasonRemote.String() {
+			want = 1
+		}
+		if count != want {
+			t.Fatalf("%d disconnects for %s, want %d", count, reason, want)
+		}
+	}
+
+	var b strings.Builder
+	if err := m.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"kcp2k_active_sessions 0",
+		"kcp2k_handshakes_accepted_total 1",
+		`kcp2k_disconnects_total{reason="remote"} 1`,
+		`kcp2k_datagrams_received_total{channel="unreliable"} 3`,
+		`kcp2k_datagrams_sent_total{channel="unreliable"} 2`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Fatalf("no %q in\n%s", line, b.String())
+		}
+	}
+}
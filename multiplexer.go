@@ -0,0 +1,143 @@
+package kcp2k
+
+import (
+	"github.com/0990/kcp2k-go/pkg/syncx"
+	"github.com/pkg/errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Multiplexer dials many servers from one UDP socket and one read goroutine,
+// dispatching datagrams to its sessions by remote address
+type Multiplexer struct {
+	conn    net.PacketConn
+	ownConn bool
+	opts    []Option
+
+	sessions syncx.Map[string, *Session]
+
+	die      chan struct{}
+	dieOnce  sync.Once
+	readDone chan struct{}
+	readErr  atomic.Value // socket error that ended readLoop
+}
+
+// NewMultiplexer binds a UDP socket to laddr, "" picks any port. opts apply to every Dial
+func NewMultiplexer(laddr string, opts ...Option) (*Multiplexer, error) {
+	var udpaddr *net.UDPAddr
+	if laddr != "" {
+		var err error
+		if udpaddr, err = net.ResolveUDPAddr("udp", laddr); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	conn, err := net.ListenUDP("udp", udpaddr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return newMultiplexer(conn, true, opts), nil
+}
+
+// NewMultiplexerConn multiplexes a caller-provided conn, which Close leaves open
+func NewMultiplexerConn(conn net.PacketConn, opts ...Option) *Multiplexer {
+	return newMultiplexer(conn, false, opts)
+}
+
+func newMultiplexer(conn net.PacketConn, ownConn bool, opts []Option) *Multiplexer {
+	m := new(Multiplexer)
+	m.conn = conn
+	m.ownConn = ownConn
+	m.opts = opts
+	m.die = make(chan struct{})
+	m.readDone = make(chan struct{})
+	go m.readLoop()
+	return m
+}
+
+// Dial handshakes with the server at raddr over the shared socket. Only one session
+// per remote address may be open at a time. opts are applied after the multiplexer's
+func (m *Multiplexer) Dial(raddr string, opts ...Option) (*Session, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return nil, errors.WithStack(&DisconnectError{Code: DnsResolve, Err: err})
+	}
+	return m.DialAddr(udpaddr, opts...)
+}
+
+func (m *Multiplexer) DialAddr(raddr net.Addr, opts ...Option) (*Session, error) {
+	select {
+	case <-m.die:
+		return nil, errors.WithStack(ErrClosed)
+	default:
+	}
+	if err, ok := m.readErr.Load().(error); ok {
+		return nil, err
+	}
+	cfg := newConfig(append(append([]Option(nil), m.opts...), opts...))
+	return dialConn(m.conn, false, raddr, cfg, m)
+}
+
+func (m *Multiplexer) add(s *Session) bool {
+	s.mux = m
+	_, loaded := m.sessions.LoadOrStore(s.RemoteAddr().String(), s)
+	// readLoop may have stopped after DialAddr checked
+	if err, ok := m.readErr.Load().(error); ok && !loaded {
+		s.notifyReadError(err)
+	}
+	return !loaded
+}
+
+func (m *Multiplexer) LocalAddr() net.Addr { return m.conn.LocalAddr() }
+
+// Close closes every session and the socket if the multiplexer created it
+func (m *Multiplexer) Close() error {
+	var once bool
+	m.dieOnce.Do(func() {
+		close(m.die)
+		once = true
+	})
+	if !once {
+		return errors.WithStack(ErrClosed)
+	}
+
+	m.sessions.Range(func(key string, s *Session) bool {
+		s.Close()
+		return true
+	})
+	if m.ownConn {
+		return errors.WithStack(m.conn.Close())
+	}
+	// wake readLoop on the caller's conn, it clears the deadline on its way out
+	m.conn.SetReadDeadline(time.Now())
+	<-m.readDone
+	return nil
+}
+
+func (m *Multiplexer) readLoop() {
+	defer close(m.readDone)
+	buf := make([]byte, mtuLimit)
+	for {
+		n, addr, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-m.die:
+				if !m.ownConn {
+					m.conn.SetReadDeadline(time.Time{})
+				}
+			default:
+				err = errors.WithStack(err)
+				m.readErr.Store(err)
+				m.sessions.Range(func(key string, s *Session) bool {
+					s.notifyReadError(err)
+					return true
+				})
+			}
+			return
+		}
+		if s, ok := m.sessions.Load(addr.String()); ok {
+			s.packetInput(buf[:n], addr)
+		}
+	}
+}
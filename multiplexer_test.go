@@ -0,0 +1,116 @@
+package kcp2k
+
+import (
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"github.com/pkg/errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMultiplexerDemux(t *testing.T) {
+	n := netsim.New(1)
+	l1, l1conn := serve(t, n, WithLogger(discardLogger))
+	defer l1conn.Close()
+	defer l1.Close()
+	l2, l2conn := serve(t, n, WithLogger(discardLogger))
+	defer l2conn.Close()
+	defer l2.Close()
+
+	conn, err := n.Listen("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	m := NewMultiplexerConn(conn, WithLogger(discardLogger))
+	defer m.Close()
+
+	c1, err := m.DialAddr(l1.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := m.DialAddr(l2.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.DialAddr(l1.Addr()); err == nil {
+		t.Fatal("dialled the same server twice")
+	}
+	s1, err := l1.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := l2.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s1.RemoteAddr().String() != s2.RemoteAddr().String() {
+		t.Fatalf("sessions dialled from %s and %s, want one socket", s1.RemoteAddr(), s2.RemoteAddr())
+	}
+
+	// each server's messages reach only the session that dialled it
+	send(t, s1, "to c1")
+	send(t, s2, "to c2")
+	if got := readString(t, c1); got != "to c1" {
+		t.Fatalf("c1 got %q", got)
+	}
+	if got := readString(t, c2); got != "to c2" {
+		t.Fatalf("c2 got %q", got)
+	}
+	send(t, c2, "from c2")
+	if got := readString(t, s2); got != "from c2" {
+		t.Fatalf("s2 got %q", got)
+	}
+
+	// closing one session leaves the other and frees its address
+	c1.Close()
+	send(t, c2, "still here")
+	if got := readString(t, s2); got != "still here" {
+		t.Fatalf("s2 got %q", got)
+	}
+	c1, err = m.DialAddr(l1.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+}
+
+func TestMultiplexerDialAfterSocketError(t *testing.T) {
+	n := netsim.New(1)
+	l, lconn := serve(t, n, WithLogger(discardLogger))
+	defer lconn.Close()
+	defer l.Close()
+
+	conn, err := n.Listen("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMultiplexerConn(conn, WithLogger(discardLogger))
+	defer m.Close()
+	c, err := m.DialAddr(l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	conn.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := c.Read(make([]byte, mtuLimit)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Read after the socket closed returned %v", err)
+	}
+	<-m.readDone
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := m.DialAddr(l.Addr(), WithHandshakeTimeout(time.Minute))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Dial returned %v, want the socket's error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dial hangs after the socket failed")
+	}
+}
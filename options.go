@@ -0,0 +1,287 @@
+package kcp2k
+
+import (
+	"log/slog"
+	"time"
+)
+
+type config struct {
+	logger  *slog.Logger
+	onError func(err error)
+	admit   AdmitFunc
+
+	maxSessions          int
+	maxSessionsPerIP     int
+	maxPendingHandshakes int
+
+	rateLimits      [channelCount]RateLimit
+	rateLimitAction RateLimitAction
+
+	handshakeTimeout  time.Duration
+	onHandshakeFailed OnHandshakeFailedFunc
+
+	localAddr string
+
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+	idleTimeout  time.Duration
+
+	reconnectMinDelay    time.Duration
+	reconnectMaxDelay    time.Duration
+	reconnectMaxAttempts int
+	gapPolicy            GapPolicy
+	gapBufferSize        int
+	onReconnecting       OnReconnectingFunc
+	onReconnected        func(s *Session)
+
+	resumeGrace time.Duration
+	resumeFrom  *Session
+	onSuspended func(s *Session)
+	onResumed   func(s *Session)
+
+	clock Clock
+
+	logBurst    int
+	logInterval time.Duration
+	warnLimiter *logLimiter
+}
+
+// Option configures a Listener or a dialled Session
+type Option func(*config)
+
+func newConfig(opts []Option) *config {
+	c := &config{
+		logger:      slog.Default(),
+		clock:       realClock{},
+		logBurst:    10,
+		logInterval: time.Second,
+
+		handshakeTimeout: HandshakeTimeoutDefault,
+
+		pingInterval: pingInterval,
+		pingTimeout:  PingTimeout,
+
+		reconnectMinDelay: reconnectMinDelay,
+		reconnectMaxDelay: reconnectMaxDelay,
+		gapBufferSize:     gapBufferSize,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.warnLimiter = newLogLimiter(c.logBurst, c.logInterval, c.clock)
+	return c
+}
+
+// WithLogger sets the logger used by the listener or session and every session it creates
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *config) {
+		if logger != nil {
+			c.logger = logger
+		}
+	}
+}
+
+// WithLogRateLimit lets through at most burst per-packet warnings of each kind per interval,
+// burst<=0 disables rate limiting
+func WithLogRateLimit(burst int, interval time.Duration) Option {
+	return func(c *config) {
+		c.logBurst = burst
+		c.logInterval = interval
+	}
+}
+
+// WithOnError sets a hook for listener errors: socket read errors (also returned by Accept)
+// and failed kcp session setups, which are otherwise only logged
+func WithOnError(fn func(err error)) Option {
+	return func(c *config) {
+		c.onError = fn
+	}
+}
+
+// WithAdmitFunc sets a hook that decides whether an unknown address may start a handshake,
+// rejected datagrams are dropped before any session state is created. See IPFilter
+func WithAdmitFunc(fn AdmitFunc) Option {
+	return func(c *config) {
+		c.admit = fn
+	}
+}
+
+// WithMaxSessions caps the sessions a listener holds, sessions still in the handshake included
+func WithMaxSessions(n int) Option {
+	return func(c *config) {
+		c.maxSessions = n
+	}
+}
+
+// WithMaxSessionsPerIP caps the sessions a single IP address may hold
+func WithMaxSessionsPerIP(n int) Option {
+	return func(c *config) {
+		c.maxSessionsPerIP = n
+	}
+}
+
+// WithMaxPendingHandshakes caps the sessions that haven't completed the handshake yet
+func WithMaxPendingHandshakes(n int) Option {
+	return func(c *config) {
+		c.maxPendingHandshakes = n
+	}
+}
+
+// WithRateLimit limits the inbound messages each session accepts on channel
+func WithRateLimit(channel Channel, limit RateLimit) Option {
+	return func(c *config) {
+		if channel == Reliable || channel == Unreliable {
+			c.rateLimits[channel] = limit
+		}
+	}
+}
+
+// WithRateLimitAction sets what happens to messages over a RateLimit, RateLimitDrop by default
+func WithRateLimitAction(action RateLimitAction) Option {
+	return func(c *config) {
+		c.rateLimitAction = action
+	}
+}
+
+// WithPingInterval sets how often sessions ping their peer, 1s by default
+func WithPingInterval(d time.Duration) Option {
+	return func(c *config) {
+		if d > 0 {
+			c.pingInterval = d
+		}
+	}
+}
+
+// WithPingTimeout sets how long a session may receive nothing at all, on either channel,
+// before it's disconnected with Timeout. PingTimeout by default
+func WithPingTimeout(d time.Duration) Option {
+	return func(c *config) {
+		if d > 0 {
+			c.pingTimeout = d
+		}
+	}
+}
+
+// WithIdleTimeout disconnects sessions that receive no messages, only pings, for d.
+// Disabled by default
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.idleTimeout = d
+	}
+}
+
+// WithHandshakeTimeout bounds both waiting for the peer's kcp session and for its Hello,
+// HandshakeTimeoutDefault by default
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(c *config) {
+		if d > 0 {
+			c.handshakeTimeout = d
+		}
+	}
+}
+
+// WithOnHandshakeFailed sets a hook called for every failed handshake,
+// the half-created session has already been removed when it runs
+func WithOnHandshakeFailed(fn OnHandshakeFailedFunc) Option {
+	return func(c *config) {
+		c.onHandshakeFailed = fn
+	}
+}
+
+// WithLocalAddr binds the socket DialWithOptions creates to laddr, such as "192.168.1.10:0"
+// to pick an interface or ":7777" to pick a port
+func WithLocalAddr(laddr string) Option {
+	return func(c *config) {
+		c.localAddr = laddr
+	}
+}
+
+// WithReconnectBackoff sets the delay before the first reconnect attempt and the cap it doubles up to.
+// Used by ReconnectingClient only
+func WithReconnectBackoff(min, max time.Duration) Option {
+	return func(c *config) {
+		if min > 0 {
+			c.reconnectMinDelay = min
+		}
+		if max >= c.reconnectMinDelay {
+			c.reconnectMaxDelay = max
+		}
+	}
+}
+
+// WithReconnectMaxAttempts makes a ReconnectingClient give up and close after n failed attempts in a row.
+// 0, the default, retries forever
+func WithReconnectMaxAttempts(n int) Option {
+	return func(c *config) {
+		c.reconnectMaxAttempts = n
+	}
+}
+
+// WithGapPolicy sets what a ReconnectingClient does with reliable messages sent while reconnecting.
+// bufferSize caps the messages GapBuffer holds, <= 0 keeps the default
+func WithGapPolicy(policy GapPolicy, bufferSize int) Option {
+	return func(c *config) {
+		c.gapPolicy = policy
+		if bufferSize > 0 {
+			c.gapBufferSize = bufferSize
+		}
+	}
+}
+
+// WithOnReconnecting is called before each attempt a ReconnectingClient makes
+func WithOnReconnecting(fn OnReconnectingFunc) Option {
+	return func(c *config) {
+		c.onReconnecting = fn
+	}
+}
+
+// WithOnReconnected is called with the new session once a ReconnectingClient is back online
+func WithOnReconnected(fn func(s *Session)) Option {
+	return func(c *config) {
+		c.onReconnected = fn
+	}
+}
+
+// WithResumption opts in to session resumption. A Listener keeps a session whose ping timeout
+// expired suspended for grace, and a client presenting its token within that time resumes it.
+// For a dialled session grace is only a switch: any positive value, such as WithResumption(1),
+// asks the server for a token and the server's grace applies.
+// While suspended, reliable sends are buffered like GapBuffer and Read blocks. Unacked
+// messages of the dropped connection are lost, Session.ResumeLost tells each side how many
+func WithResumption(grace time.Duration) Option {
+	return func(c *config) {
+		c.resumeGrace = grace
+	}
+}
+
+// WithResume makes a dialled session ask to resume the server session of old, which has
+// dropped. It needs WithResumption, see Session.Resumed for the outcome
+func WithResume(old *Session) Option {
+	return func(c *config) {
+		c.resumeFrom = old
+	}
+}
+
+// WithOnSuspended is called when a Listener suspends s instead of closing it on a ping timeout
+func WithOnSuspended(fn func(s *Session)) Option {
+	return func(c *config) {
+		c.onSuspended = fn
+	}
+}
+
+// WithOnResumed is called when a client resumed s, s.ResumeLost is set by then
+func WithOnResumed(fn func(s *Session)) Option {
+	return func(c *config) {
+		c.onResumed = fn
+	}
+}
+
+// WithClock replaces the real clock, mainly to drive ping, handshake and idle timeouts from tests.
+// Log rate limiting runs on it too
+func WithClock(clock Clock) Option {
+	return func(c *config) {
+		if clock != nil {
+			c.clock = clock
+		}
+	}
+}
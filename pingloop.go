@@ -1,32 +1,52 @@
 package kcp2k
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 const pingInterval = time.Millisecond * 1000
 const PingTimeout = time.Second * 5
 
 func (s *Session) pingLoop() {
-	workSignal := make(chan struct{}, 1)
-
-	time.AfterFunc(pingInterval, func() {
-		workSignal <- struct{}{}
-	})
+	kcpSess := s.kcpSession()
+	timer := s.cfg.clock.NewTimer(loadDuration(&s.pingInterval))
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-s.die:
 			return
-		case <-workSignal:
-			t := s.lastPingReceiveTime.Load().(time.Time)
-			if time.Since(t) > PingTimeout {
-				s.Close()
+		case <-timer.C():
+			if s.replaced(kcpSess) {
+				// suspended, resume starts a new loop
+				return
+			}
+			now := s.cfg.clock.Now()
+			if timeout := loadDuration(&s.pingTimeout); now.Sub(loadTime(&s.lastReceiveTime)) > timeout {
+				if !s.suspend() {
+					s.disconnect(reasonTimeout, Timeout, ErrTimeout)
+				}
+				return
+			}
+			if idle := loadDuration(&s.idleTimeout); idle > 0 && now.Sub(loadTime(&s.lastDataTime)) > idle {
+				s.disconnect(reasonIdle, Timeout, fmt.Errorf("idle for %s: %w", idle, ErrTimeout))
 				return
 			}
 
-			s.sendReliable(Ping, nil)
-			time.AfterFunc(pingInterval, func() {
-				workSignal <- struct{}{}
-			})
+			// a full send window already keeps the peer busy, and blocking here would stop the timeout checks
+			s.writeNoWait(kcpSess, []byte{byte(Ping)})
+			timer.Reset(loadDuration(&s.pingInterval))
 		}
 	}
 }
+
+// SetPingInterval overrides how often this session pings its peer
+func (s *Session) SetPingInterval(d time.Duration) { s.pingInterval.Store(int64(d)) }
+
+// SetPingTimeout overrides how long this session may receive nothing at all before it's disconnected
+func (s *Session) SetPingTimeout(d time.Duration) { s.pingTimeout.Store(int64(d)) }
+
+// SetIdleTimeout overrides how long this session may receive no messages, only pings,
+// before it's disconnected. 0 disables it. It is checked once per ping interval
+func (s *Session) SetIdleTimeout(d time.Duration) { s.idleTimeout.Store(int64(d)) }
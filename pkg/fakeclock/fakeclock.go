@@ -0,0 +1,151 @@
+// Package fakeclock is a manually advanced kcp2k.Clock, so ping, handshake and idle timeouts
+// can be tested without sleeping
+package fakeclock
+
+import (
+	kcp2k "github.com/0990/kcp2k-go"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Clock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	seq    uint64
+	timers []*timer // armed timers
+}
+
+var _ kcp2k.Clock = (*Clock)(nil)
+
+func New(start time.Time) *Clock {
+	c := &Clock{now: start}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *Clock) NewTimer(d time.Duration) kcp2k.Timer {
+	t := &timer{c: c, ch: make(chan time.Time, 1)}
+	t.Reset(d)
+	return t
+}
+
+// AfterFunc runs f in its own goroutine once the clock is advanced past d, like time.AfterFunc
+func (c *Clock) AfterFunc(d time.Duration, f func()) kcp2k.Timer {
+	t := &timer{c: c, f: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers due on the way in order.
+// Timers armed by the fired ones are only seen by the next Advance
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	var due []*timer
+	for _, t := range c.timers {
+		if !t.when.After(end) {
+			due = append(due, t)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].when.Equal(due[j].when) {
+			return due[i].seq < due[j].seq
+		}
+		return due[i].when.Before(due[j].when)
+	})
+	for _, t := range due {
+		c.remove(t)
+	}
+	c.mu.Unlock()
+
+	for _, t := range due {
+		c.mu.Lock()
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		c.mu.Unlock()
+		t.fire()
+	}
+
+	c.mu.Lock()
+	if end.After(c.now) {
+		c.now = end
+	}
+	c.mu.Unlock()
+}
+
+// BlockUntil waits until at least n timers are armed, so a test can advance the clock
+// only after the goroutines under test started waiting on it
+func (c *Clock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+// Timers returns the number of armed timers
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// remove must be called with c.mu held
+func (c *Clock) remove(t *timer) bool {
+	for i, armed := range c.timers {
+		if armed == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type timer struct {
+	c    *Clock
+	when time.Time
+	seq  uint64
+	ch   chan time.Time
+	f    func()
+}
+
+func (t *timer) C() <-chan time.Time { return t.ch }
+
+func (t *timer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	return t.c.remove(t)
+}
+
+func (t *timer) Reset(d time.Duration) bool {
+	c := t.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	active := c.remove(t)
+	c.seq++
+	t.seq = c.seq
+	t.when = c.now.Add(d)
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return active
+}
+
+func (t *timer) fire() {
+	if t.f != nil {
+		go t.f()
+		return
+	}
+	select {
+	case t.ch <- t.when:
+	default:
+	}
+}
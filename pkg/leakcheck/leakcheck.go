@@ -0,0 +1,72 @@
+// Package leakcheck finds goroutines left running after closing listeners and sessions
+package leakcheck
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Snapshot is the set of goroutines running when it was taken
+type Snapshot map[string]struct{}
+
+// Take records the goroutines running now
+func Take() Snapshot {
+	snap := make(Snapshot)
+	for id := range goroutines() {
+		snap[id] = struct{}{}
+	}
+	return snap
+}
+
+// Check waits up to timeout for every goroutine started since the snapshot to exit.
+// It returns an error with their stacks if some are still running
+func (s Snapshot) Check(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		leaked := s.leaked()
+		if len(leaked) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d goroutines leaked:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s Snapshot) leaked() []string {
+	var leaked []string
+	for id, stack := range goroutines() {
+		if _, ok := s[id]; !ok {
+			leaked = append(leaked, stack)
+		}
+	}
+	return leaked
+}
+
+// goroutines returns the stacks of all goroutines but the caller's, by goroutine id
+func goroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	stacks := make(map[string]string)
+	for i, g := range bytes.Split(buf, []byte("\n\n")) {
+		if i == 0 {
+			continue // 当前goroutine
+		}
+		// "goroutine 42 [chan receive]:"
+		header, _, _ := strings.Cut(string(g), " [")
+		stacks[header] = string(g)
+	}
+	return stacks
+}
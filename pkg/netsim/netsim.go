@@ -0,0 +1,428 @@
+// Package netsim is an in-memory lossy network for running kcp2k over ServeConn and DialConn
+// without real sockets
+package netsim
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	inboxSize     = 1024
+	defaultBuffer = 64 * 1024
+)
+
+// Link shapes the traffic in one direction between two conns
+type Link struct {
+	Latency time.Duration
+	// Jitter adds a random [0, Jitter) delay per datagram, it doesn't reorder on its own
+	Jitter time.Duration
+	// Loss, Duplicate and Reorder are probabilities in [0, 1]. A reordered datagram is held
+	// back by up to max(Latency, 10ms) so later ones overtake it
+	Loss      float64
+	Duplicate float64
+	Reorder   float64
+	// Bandwidth caps the link in bytes per second, 0 means unlimited. Datagrams that would
+	// queue more than Buffer bytes are dropped, Buffer defaults to 64KB
+	Bandwidth int
+	Buffer    int
+}
+
+// LinkStats counts what happened to the datagrams written on one link
+type LinkStats struct {
+	Sent       uint64
+	Delivered  uint64
+	Lost       uint64
+	Duplicated uint64
+	Reordered  uint64
+	Overflowed uint64 // dropped by the bandwidth buffer or a full inbox
+}
+
+type linkKey struct{ from, to netip.AddrPort }
+
+type link struct {
+	Link
+	explicit  bool // shaped by SetLink, SetDefaultLink leaves it alone
+	rng       *rand.Rand
+	busyUntil time.Time // bandwidth queue drains at
+	lastAt    time.Time // keeps jittered datagrams in order
+	stats     LinkStats
+
+	// datagrams in flight, delivered by one timer so equal times keep their order
+	inflight inflight
+	seq      uint64
+	timer    *time.Timer
+}
+
+// Network connects the conns created by Listen. The RNG of every link is derived from the seed,
+// so a single-writer link replays the same losses for the same seed
+type Network struct {
+	seed int64
+
+	mu    sync.Mutex
+	def   Link
+	links map[linkKey]*link
+	conns map[netip.AddrPort]*Conn
+	port  uint16 // last port handed out by Listen("")
+}
+
+func New(seed int64) *Network {
+	return &Network{
+		seed:  seed,
+		links: make(map[linkKey]*link),
+		conns: make(map[netip.AddrPort]*Conn),
+	}
+}
+
+// Pipe is a two-conn network, ab shapes a->b and ba b->a
+func Pipe(seed int64, ab, ba Link) (a, b *Conn) {
+	n := New(seed)
+	a, _ = n.Listen("192.0.2.1:1")
+	b, _ = n.Listen("192.0.2.2:1")
+	n.SetLink(a.LocalAddr(), b.LocalAddr(), ab)
+	n.SetLink(b.LocalAddr(), a.LocalAddr(), ba)
+	return a, b
+}
+
+// SetDefaultLink shapes every direction without its own SetLink
+func (n *Network) SetDefaultLink(l Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.def = l
+	for _, lk := range n.links {
+		if !lk.explicit {
+			lk.Link = l
+		}
+	}
+}
+
+// SetLink shapes the traffic from one address to another
+func (n *Network) SetLink(from, to net.Addr, l Link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	lk := n.link(addrPortOf(from), addrPortOf(to))
+	lk.Link = l
+	lk.explicit = true
+}
+
+func (n *Network) Stats(from, to net.Addr) LinkStats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.link(addrPortOf(from), addrPortOf(to)).stats
+}
+
+// link must be called with n.mu held
+func (n *Network) link(from, to netip.AddrPort) *link {
+	key := linkKey{from, to}
+	if lk, ok := n.links[key]; ok {
+		return lk
+	}
+	h := fnv.New64a()
+	h.Write([]byte(from.String() + ">" + to.String()))
+	lk := &link{Link: n.def, rng: rand.New(rand.NewSource(n.seed ^ int64(h.Sum64())))}
+	n.links[key] = lk
+	return lk
+}
+
+// Listen attaches a conn at addr, "ip:port". "" picks a free port on 198.51.100.1
+func (n *Network) Listen(addr string) (*Conn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var ap netip.AddrPort
+	if addr == "" {
+		for {
+			n.port++
+			ap = netip.AddrPortFrom(netip.AddrFrom4([4]byte{198, 51, 100, 1}), n.port)
+			if _, ok := n.conns[ap]; !ok {
+				break
+			}
+		}
+	} else {
+		var err error
+		if ap, err = netip.ParseAddrPort(addr); err != nil {
+			return nil, err
+		}
+		ap = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+	}
+	if _, ok := n.conns[ap]; ok {
+		return nil, &net.OpError{Op: "listen", Net: "netsim", Addr: net.UDPAddrFromAddrPort(ap), Err: os.ErrExist}
+	}
+	c := &Conn{
+		n:     n,
+		addr:  ap,
+		inbox: make(chan *packet, inboxSize),
+		rdCh:  make(chan struct{}),
+		die:   make(chan struct{}),
+	}
+	n.conns[ap] = c
+	return c, nil
+}
+
+// send schedules the copies of b that survive the link
+func (n *Network) send(from, to netip.AddrPort, b []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	dst := n.conns[to]
+	lk := n.link(from, to)
+	lk.stats.Sent++
+
+	copies := 1
+	if lk.rng.Float64() < lk.Duplicate {
+		copies++
+		lk.stats.Duplicated++
+	}
+	now := time.Now()
+	for i := 0; i < copies; i++ {
+		if lk.rng.Float64() < lk.Loss || dst == nil {
+			lk.stats.Lost++
+			continue
+		}
+
+		at := now
+		if lk.Bandwidth > 0 {
+			buffer := lk.Buffer
+			if buffer <= 0 {
+				buffer = defaultBuffer
+			}
+			if lk.busyUntil.Before(now) {
+				lk.busyUntil = now
+			}
+			// 队列里已有的字节数超过缓冲则丢弃
+			if queued := int(lk.busyUntil.Sub(now).Seconds() * float64(lk.Bandwidth)); queued+len(b) > buffer {
+				lk.stats.Overflowed++
+				continue
+			}
+			lk.busyUntil = lk.busyUntil.Add(time.Duration(len(b)) * time.Second / time.Duration(lk.Bandwidth))
+			at = lk.busyUntil
+		}
+		at = at.Add(lk.Latency)
+		if lk.Jitter > 0 {
+			at = at.Add(time.Duration(lk.rng.Int63n(int64(lk.Jitter))))
+		}
+
+		if lk.rng.Float64() < lk.Reorder {
+			hold := lk.Latency
+			if hold < 10*time.Millisecond {
+				hold = 10 * time.Millisecond
+			}
+			at = at.Add(time.Duration(lk.rng.Int63n(int64(hold))) + 1)
+			lk.stats.Reordered++
+		} else {
+			if at.Before(lk.lastAt) {
+				at = lk.lastAt
+			}
+			lk.lastAt = at
+		}
+
+		lk.seq++
+		heap.Push(&lk.inflight, &packet{data: append([]byte(nil), b...), from: from, dst: dst, at: at, seq: lk.seq})
+		if lk.inflight[0].seq == lk.seq {
+			n.schedule(lk)
+		}
+	}
+}
+
+// schedule arms the link's timer for its earliest datagram, n.mu must be held
+func (n *Network) schedule(lk *link) {
+	d := time.Until(lk.inflight[0].at)
+	if lk.timer == nil {
+		lk.timer = time.AfterFunc(d, func() { n.deliver(lk) })
+		return
+	}
+	lk.timer.Reset(d)
+}
+
+func (n *Network) deliver(lk *link) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	for len(lk.inflight) > 0 && !lk.inflight[0].at.After(now) {
+		p := heap.Pop(&lk.inflight).(*packet)
+		select {
+		case <-p.dst.die:
+			lk.stats.Lost++
+		case p.dst.inbox <- p:
+			lk.stats.Delivered++
+		default:
+			lk.stats.Overflowed++
+		}
+	}
+	if len(lk.inflight) > 0 {
+		n.schedule(lk)
+	}
+}
+
+func (n *Network) remove(c *Conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conns[c.addr] == c {
+		delete(n.conns, c.addr)
+	}
+}
+
+type packet struct {
+	data []byte
+	from netip.AddrPort
+	dst  *Conn
+	at   time.Time
+	seq  uint64
+}
+
+// inflight is a min-heap by delivery time, then send order
+type inflight []*packet
+
+func (h inflight) Len() int { return len(h) }
+func (h inflight) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h inflight) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *inflight) Push(x any)   { *h = append(*h, x.(*packet)) }
+func (h *inflight) Pop() any {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
+
+// Conn is a net.PacketConn on a Network
+type Conn struct {
+	n    *Network
+	addr netip.AddrPort
+
+	inbox chan *packet
+
+	mu   sync.Mutex
+	rd   time.Time
+	wd   time.Time
+	rdCh chan struct{} // wakes blocked reads when rd changes
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		rd, rdCh := c.rd, c.rdCh
+		c.mu.Unlock()
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !rd.IsZero() {
+			timer = time.NewTimer(time.Until(rd))
+			timeout = timer.C
+		}
+
+		select {
+		case p := <-c.inbox:
+			stopTimer(timer)
+			n := copy(b, p.data)
+			return n, net.UDPAddrFromAddrPort(p.from), nil
+		case <-timeout:
+			return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+		case <-rdCh:
+			stopTimer(timer)
+		case <-c.die:
+			stopTimer(timer)
+			return 0, nil, c.opError("read", net.ErrClosed)
+		}
+	}
+}
+
+// WriteTo never blocks, datagrams to an address nobody listens on are lost like with UDP
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.die:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+
+	c.mu.Lock()
+	wd := c.wd
+	c.mu.Unlock()
+	if !wd.IsZero() && time.Now().After(wd) {
+		return 0, c.opError("write", os.ErrDeadlineExceeded)
+	}
+
+	c.n.send(c.addr, addrPortOf(addr), b)
+	return len(b), nil
+}
+
+func (c *Conn) Close() error {
+	var once bool
+	c.dieOnce.Do(func() {
+		close(c.die)
+		once = true
+	})
+	if !once {
+		return c.opError("close", net.ErrClosed)
+	}
+	c.n.remove(c)
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr { return net.UDPAddrFromAddrPort(c.addr) }
+
+// SetDeadline and SetReadDeadline also apply to a blocked ReadFrom, like a UDP socket
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wd = t
+	c.setReadDeadline(t)
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setReadDeadline(t)
+	return nil
+}
+
+// setReadDeadline must be called with c.mu held
+func (c *Conn) setReadDeadline(t time.Time) {
+	c.rd = t
+	close(c.rdCh)
+	c.rdCh = make(chan struct{})
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wd = t
+	return nil
+}
+
+func (c *Conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "netsim", Addr: c.LocalAddr(), Err: err}
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+func addrPortOf(addr net.Addr) netip.AddrPort {
+	var ap netip.AddrPort
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		ap = udpAddr.AddrPort()
+	} else {
+		ap, _ = netip.ParseAddrPort(addr.String())
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+var _ net.PacketConn = (*Conn)(nil)
@@ -0,0 +1,187 @@
+package netsim_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/0990/kcp2k-go"
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readAll reads until nothing arrives for 100ms
+func readAll(t *testing.T, c *netsim.Conn) [][]byte {
+	t.Helper()
+	var got [][]byte
+	buf := make([]byte, 1500)
+	for {
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := c.ReadFrom(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return got
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, append([]byte(nil), buf[:n]...))
+	}
+}
+
+// shaped sends count numbered datagrams over a link and returns the numbers in the order received
+func shaped(t *testing.T, seed int64, l netsim.Link, count int) ([]uint32, netsim.LinkStats) {
+	t.Helper()
+	n := netsim.New(seed)
+	a, _ := n.Listen("")
+	b, _ := n.Listen("")
+	defer a.Close()
+	defer b.Close()
+	n.SetLink(a.LocalAddr(), b.LocalAddr(), l)
+
+	for i := 0; i < count; i++ {
+		if _, err := a.WriteTo(binary.BigEndian.AppendUint32(nil, uint32(i)), b.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var seqs []uint32
+	for _, d := range readAll(t, b) {
+		seqs = append(seqs, binary.BigEndian.Uint32(d))
+	}
+	return seqs, n.Stats(a.LocalAddr(), b.LocalAddr())
+}
+
+func TestSeededLossDuplicateReorder(t *testing.T) {
+	const count = 500
+	link := netsim.Link{Loss: 0.2, Duplicate: 0.1, Reorder: 0.1}
+	seqs, stats := shaped(t, 42, link, count)
+
+	if stats.Sent != count || stats.Delivered != uint64(len(seqs)) {
+		t.Fatalf("stats %+v for %d received", stats, len(seqs))
+	}
+	if stats.Lost < count/10 || stats.Lost > count*3/10 {
+		t.Fatalf("lost %d of %d at 20%% loss", stats.Lost, count)
+	}
+	if stats.Duplicated == 0 || stats.Reordered == 0 {
+		t.Fatalf("stats %+v, want duplicates and reordering", stats)
+	}
+
+	seen := make(map[uint32]int)
+	var reordered bool
+	for i, seq := range seqs {
+		seen[seq]++
+		if i > 0 && seq < seqs[i-1] {
+			reordered = true
+		}
+	}
+	var dups int
+	for _, n := range seen {
+		dups += n - 1
+	}
+	if dups == 0 || !reordered {
+		t.Fatalf("received %d duplicates, reordered %v", dups, reordered)
+	}
+
+	// the same seed loses and duplicates the same datagrams, only timing may differ
+	again, _ := shaped(t, 42, link, count)
+	if !reflect.DeepEqual(counts(seqs), counts(again)) {
+		t.Fatal("same seed, different datagrams delivered")
+	}
+	other, _ := shaped(t, 43, link, count)
+	if reflect.DeepEqual(counts(seqs), counts(other)) {
+		t.Fatal("different seeds, same datagrams delivered")
+	}
+}
+
+func counts(seqs []uint32) map[uint32]int {
+	m := make(map[uint32]int)
+	for _, seq := range seqs {
+		m[seq]++
+	}
+	return m
+}
+
+func TestSetDefaultLinkKeepsSetLink(t *testing.T) {
+	n := netsim.New(1)
+	a, _ := n.Listen("")
+	b, _ := n.Listen("")
+	c, _ := n.Listen("")
+
+	n.SetLink(a.LocalAddr(), b.LocalAddr(), netsim.Link{Loss: 1})
+	a.WriteTo([]byte("x"), c.LocalAddr()) // creates a->c with the old default
+	readAll(t, c)
+	n.SetDefaultLink(netsim.Link{Duplicate: 1})
+
+	a.WriteTo([]byte("x"), b.LocalAddr())
+	if got := readAll(t, b); len(got) != 0 {
+		t.Fatalf("SetDefaultLink replaced a SetLink link, %d delivered", len(got))
+	}
+	a.WriteTo([]byte("x"), c.LocalAddr())
+	if got := readAll(t, c); len(got) != 2 {
+		t.Fatalf("%d delivered on a default link, want the duplicate too", len(got))
+	}
+}
+
+func TestLatency(t *testing.T) {
+	a, b := netsim.Pipe(1, netsim.Link{Latency: 50 * time.Millisecond}, netsim.Link{})
+	start := time.Now()
+	a.WriteTo([]byte("x"), b.LocalAddr())
+	if _, _, err := b.ReadFrom(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("delivered after %s, want 50ms latency", d)
+	}
+}
+
+func TestServeConnDialConn(t *testing.T) {
+	link := netsim.Link{Latency: 5 * time.Millisecond, Jitter: time.Millisecond}
+	a, b := netsim.Pipe(1, link, link)
+
+	l, err := kcp2k.ServeConn(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		buf := make([]byte, kcp2k.ReliableMaxMessageSize)
+		for {
+			n, channel, err := s.Read(buf)
+			if err != nil {
+				return
+			}
+			s.Send(buf[:n], channel)
+		}
+	}()
+
+	c, err := kcp2k.DialConn(b, a.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, kcp2k.ReliableMaxMessageSize)
+	for _, channel := range []kcp2k.Channel{kcp2k.Reliable, kcp2k.Unreliable} {
+		msg := []byte("hello " + channel.String())
+		if _, err := c.Send(msg, channel); err != nil {
+			t.Fatal(err)
+		}
+		n, got, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != channel || string(buf[:n]) != string(msg) {
+			t.Fatalf("echo %q on %s, want %q on %s", buf[:n], got, msg, channel)
+		}
+	}
+	if _, ok := c.RemoteAddr().(*net.UDPAddr); !ok {
+		t.Fatalf("remote address %T, want *net.UDPAddr", c.RemoteAddr())
+	}
+}
@@ -0,0 +1,109 @@
+// Package trace records the datagrams of a net.PacketConn as JSON lines, for capturing
+// sessions with other kcp2k implementations and replaying them later
+package trace
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type Direction string
+
+const (
+	In  Direction = "in"
+	Out Direction = "out"
+)
+
+// Record is one datagram. Offset is the time since the recorder started
+type Record struct {
+	Offset time.Duration `json:"offset"`
+	Dir    Direction     `json:"dir"`
+	Addr   string        `json:"addr"`
+	Data   HexBytes      `json:"data"`
+}
+
+// HexBytes marshals as a hex string so fixtures stay readable and diffable
+type HexBytes []byte
+
+func (b HexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+func (b *HexBytes) UnmarshalText(text []byte) error {
+	d, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*b = d
+	return nil
+}
+
+// Conn is a net.PacketConn that writes every datagram read or written to a trace
+type Conn struct {
+	net.PacketConn
+
+	start time.Time
+	mu    sync.Mutex
+	enc   *json.Encoder
+	err   error
+}
+
+// NewConn records conn to w, one JSON Record per line
+func NewConn(conn net.PacketConn, w io.Writer) *Conn {
+	return &Conn{PacketConn: conn, start: time.Now(), enc: json.NewEncoder(w)}
+}
+
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		c.record(In, addr, b[:n])
+	}
+	return n, addr, err
+}
+
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		c.record(Out, addr, b[:n])
+	}
+	return n, err
+}
+
+// Err returns the first error writing the trace, recording stops after it
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *Conn) record(dir Direction, addr net.Addr, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = c.enc.Encode(Record{Offset: time.Since(c.start), Dir: dir, Addr: addr.String(), Data: data})
+}
+
+// ReadAll loads a trace written by Conn
+func ReadAll(r io.Reader) ([]Record, error) {
+	var records []Record
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+	return records, sc.Err()
+}
@@ -0,0 +1,107 @@
+package kcp2k
+
+import "time"
+
+// RateLimit limits inbound messages on one channel of a session, zero fields are unlimited.
+// Bursts of up to one second's worth of traffic are allowed, and at least one message of the
+// channel's max size so that a legitimate large message always fits
+type RateLimit struct {
+	MessagesPerSecond float64
+	BytesPerSecond    float64
+}
+
+// RateLimitAction is what a session does with a message over its RateLimit
+type RateLimitAction byte
+
+const (
+	RateLimitDrop       RateLimitAction = iota // drop the message and count it
+	RateLimitLog                               // drop, count and log the message
+	RateLimitDisconnect                        // disconnect the session with InvalidReceive
+)
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst = max(burst, rate)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// inboundLimiter enforces a RateLimit. Each channel is only fed from one goroutine,
+// the read loop for Unreliable and readKcpLoop for Reliable, so it needs no lock
+type inboundLimiter struct {
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func newInboundLimiter(channel Channel, limit RateLimit) *inboundLimiter {
+	if limit.MessagesPerSecond <= 0 && limit.BytesPerSecond <= 0 {
+		return nil
+	}
+	maxSize := ReliableMaxMessageSize
+	if channel == Unreliable {
+		maxSize = UnreliableMaxMessageSize
+	}
+	return &inboundLimiter{
+		messages: newTokenBucket(limit.MessagesPerSecond, 1),
+		bytes:    newTokenBucket(limit.BytesPerSecond, float64(maxSize)),
+	}
+}
+
+// allow takes one message of n bytes from the buckets, or nothing if either is short
+func (l *inboundLimiter) allow(now time.Time, n int) bool {
+	if l.messages != nil {
+		l.messages.refill(now)
+		if l.messages.tokens < 1 {
+			return false
+		}
+	}
+	if l.bytes != nil {
+		l.bytes.refill(now)
+		if l.bytes.tokens < float64(n) {
+			return false
+		}
+		l.bytes.tokens -= float64(n)
+	}
+	if l.messages != nil {
+		l.messages.tokens--
+	}
+	return true
+}
+
+// allowInbound charges a message of n bytes against the channel's rate limit. ok is false if
+// the message must not be delivered, err is set if the session was disconnected for it
+func (s *Session) allowInbound(channel Channel, n int) (ok bool, err error) {
+	limiter := s.limiters[channel]
+	if limiter == nil || limiter.allow(s.cfg.clock.Now(), n) {
+		return true, nil
+	}
+
+	if s.l != nil {
+		s.l.metrics.rateLimited[channel].Add(1)
+	}
+	switch s.cfg.rateLimitAction {
+	case RateLimitLog:
+		s.cfg.warnLimiter.warn(s.logger(), "rate limit exceeded", "channel", channel.String(), "size", n)
+	case RateLimitDisconnect:
+		return false, s.disconnect(reasonRateLimit, InvalidReceive, ErrRateLimited)
+	}
+	return false, nil
+}
@@ -0,0 +1,42 @@
+package kcp2k
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimitBurstFitsMaxMessage(t *testing.T) {
+	now := time.Unix(0, 0)
+	for _, tc := range []struct {
+		channel Channel
+		maxSize int
+	}{
+		{Reliable, ReliableMaxMessageSize},
+		{Unreliable, UnreliableMaxMessageSize},
+	} {
+		l := newInboundLimiter(tc.channel, RateLimit{BytesPerSecond: 100})
+		if !l.allow(now, tc.maxSize) {
+			t.Fatalf("%s: a max size message over a 100B/s limit was refused", tc.channel)
+		}
+		if l.allow(now, 1) {
+			t.Fatalf("%s: the bucket wasn't drained by a max size message", tc.channel)
+		}
+		if l.allow(now.Add(time.Second), tc.maxSize) {
+			t.Fatalf("%s: refilled faster than the rate", tc.channel)
+		}
+	}
+}
+
+func TestRateLimitBelowOneMessagePerSecond(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newInboundLimiter(Reliable, RateLimit{MessagesPerSecond: 0.5})
+	if !l.allow(now, 1) {
+		t.Fatal("first message refused")
+	}
+	if l.allow(now.Add(time.Second), 1) {
+		t.Fatal("second message allowed after 1s at 0.5 msg/s")
+	}
+	if !l.allow(now.Add(2*time.Second), 1) {
+		t.Fatal("second message refused after 2s at 0.5 msg/s")
+	}
+}
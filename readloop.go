@@ -1,46 +1,63 @@
 package kcp2k
 
 import (
+	"encoding/binary"
 	"github.com/pkg/errors"
-	"log/slog"
 	"net"
+	"time"
 )
 
 func (l *Listener) monitor() {
 	l.defaultMonitor()
 }
 
+// defaultMonitor closes monitorDone before reporting a read error, OnError may call Close
 func (l *Listener) defaultMonitor() {
 	buf := make([]byte, mtuLimit)
 	for {
 		if n, from, err := l.conn.ReadFrom(buf); err == nil {
 			l.packetInput(buf[:n], from)
 		} else {
-			l.notifyReadError(errors.WithStack(err))
+			select {
+			case <-l.die:
+				if !l.ownConn {
+					l.conn.SetReadDeadline(time.Time{})
+				}
+				close(l.monitorDone)
+			default:
+				close(l.monitorDone)
+				l.notifyReadError(errors.WithStack(err))
+			}
 			return
 		}
 	}
 }
 
 func (s *Session) readLoop() {
+	defer close(s.readLoopDone)
 	s.defaultReadLoop()
 }
 
 func (s *Session) defaultReadLoop() {
 	buf := make([]byte, mtuLimit)
-	var src string
+	src := s.RemoteAddr().String()
 
 	for {
 		if n, addr, err := s.conn.ReadFrom(buf); err == nil {
-			// make sure the packet is from the same source
-			if src == "" { // set source address
-				src = addr.String()
-			} else if addr.String() != src {
+			// only the dialled address, a spoofed first datagram must not lock out the server
+			if addr.String() != src {
 				continue
 			}
 			s.packetInput(buf[:n], addr)
 		} else {
-			s.notifyReadError(errors.WithStack(err))
+			select {
+			case <-s.die:
+				if !s.ownConn {
+					s.conn.SetReadDeadline(time.Time{})
+				}
+			default:
+				s.notifyReadError(errors.WithStack(err))
+			}
 			return
 		}
 
@@ -56,11 +73,17 @@ func (s *Session) packetInput(data []byte, addr net.Addr) {
 	var channel = Channel(data[0])
 	var cookie = data[1:headerSize]
 
+	// the cookie is learned from our own conversation, not a stale datagram on a reused conn
+	if s.cookie() == nil && !s.ownsConv(channel, data[headerSize:]) {
+		return
+	}
+
 	err := s.CheckCookie(cookie)
 	if err != nil {
-		slog.With("error", err).Warn("invalid cookie")
+		s.cfg.warnLimiter.warn(s.logger(), "invalid cookie", "error", err)
 		return
 	}
+	s.lastReceiveTime.Store(s.cfg.clock.Now().UnixNano())
 
 	switch channel {
 	case Reliable:
@@ -73,3 +96,9 @@ func (s *Session) packetInput(data []byte, addr net.Addr) {
 
 	}
 }
+
+func (s *Session) ownsConv(channel Channel, kcpData []byte) bool {
+	kcpSess := s.kcpSession()
+	return channel == Reliable && kcpSess != nil && len(kcpData) >= kcpOverhead &&
+		binary.LittleEndian.Uint32(kcpData) == kcpSess.GetConv()
+}
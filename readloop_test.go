@@ -0,0 +1,74 @@
+package kcp2k
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/0990/kcp2k-go/pkg/leakcheck"
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"github.com/pkg/errors"
+	"testing"
+	"time"
+)
+
+// FuzzSessionPacketInput feeds a dialled session datagrams from its server's address. The fuzzer
+// can't guess the random cookie and conv, withCookie and withConv put the session's own in place
+func FuzzSessionPacketInput(f *testing.F) {
+	for _, seed := range []struct {
+		channel              Channel
+		withCookie, withConv bool
+		body                 []byte
+	}{
+		{Reliable, true, true, kcpSegment(0, kcpCmdPush, 1, []byte{byte(Data), 'h', 'i'})},
+		{Reliable, true, true, kcpSegment(0, kcpCmdPush, 1, []byte{byte(Disconnect)})},
+		{Reliable, true, true, kcpSegment(0, kcpCmdPush, 1, []byte{0xff})},
+		{Reliable, true, false, kcpSegment(0, kcpCmdPush, 1, []byte{byte(Data)})},
+		{Reliable, false, true, kcpSegment(0, kcpCmdPush, 1, []byte{byte(Data)})},
+		{Unreliable, true, false, []byte("hi")},
+		{Unreliable, false, false, []byte("hi")},
+		{Invalid, true, false, nil},
+	} {
+		f.Add(byte(seed.channel), seed.withCookie, seed.withConv, seed.body)
+	}
+	f.Fuzz(func(t *testing.T, channel byte, withCookie, withConv bool, body []byte) {
+		snap := leakcheck.Take()
+		n := netsim.New(1)
+		l, lconn := serve(t, n, WithLogger(discardLogger))
+		defer lconn.Close()
+		defer l.Close()
+		c, cconn := dial(t, n, l, WithLogger(discardLogger))
+		defer cconn.Close()
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		cookie := c.cookie()
+		data := append([]byte{channel, 0, 0, 0, 0}, body...)
+		if withCookie {
+			copy(data[1:headerSize], cookie)
+		}
+		if withConv && len(body) >= 4 {
+			binary.LittleEndian.PutUint32(data[headerSize:], c.kcpSession().GetConv())
+		}
+		c.packetInput(data, l.Addr())
+
+		if !bytes.Equal(c.cookie(), cookie) {
+			t.Fatalf("cookie changed from %x to %x", cookie, c.cookie())
+		}
+		if !withCookie {
+			// dropped before it reaches the session
+			c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+			if _, _, err := c.Read(make([]byte, ReliableMaxMessageSize)); !errors.Is(err, ErrTimeout) {
+				t.Fatalf("Read returned %v for a datagram without the cookie", err)
+			}
+		}
+
+		c.Close()
+		s.Close()
+		l.Close()
+		if err := snap.Check(5 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
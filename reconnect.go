@@ -0,0 +1,308 @@
+package kcp2k
+
+import (
+	"github.com/pkg/errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	reconnectMinDelay = time.Millisecond * 500
+	reconnectMaxDelay = time.Second * 30
+	gapBufferSize     = 256
+)
+
+// GapPolicy decides what happens to reliable messages sent while a ReconnectingClient is reconnecting.
+// Unreliable messages are always dropped
+type GapPolicy byte
+
+const (
+	// GapDrop rejects them with ErrReconnecting
+	GapDrop GapPolicy = iota
+	// GapBuffer queues them and sends them in order on the new session. Once the buffer
+	// is full they're rejected with ErrReconnecting
+	GapBuffer
+)
+
+// OnReconnectingFunc is called before every reconnect attempt, attempt counting from 1.
+// err is why the last session or attempt failed
+type OnReconnectingFunc func(attempt int, err error)
+
+// ReconnectingClient is a dialled session that redials with jittered exponential backoff
+// whenever it's disconnected, whether by the server, a ping timeout or a socket error
+type ReconnectingClient struct {
+	dial func(opts ...Option) (*Session, error)
+	opts []Option
+	cfg  *config
+
+	mu        sync.Mutex
+	sess      *Session
+	connected bool
+	replaced  chan struct{} // closed when sess is replaced
+	pending   [][]byte      // reliable messages buffered during the gap
+
+	die      chan struct{}
+	dieOnce  sync.Once
+	closeErr atomic.Value
+}
+
+// DialReconnecting dials raddr like DialWithOptions, failing if the first handshake does,
+// and keeps the connection up from then on
+func DialReconnecting(raddr string, opts ...Option) (*ReconnectingClient, error) {
+	return dialReconnecting(func(opts ...Option) (*Session, error) {
+		return DialWithOptions(raddr, opts...)
+	}, opts)
+}
+
+// dialReconnecting is DialReconnecting with every dial, the first included, made by dial
+func dialReconnecting(dial func(opts ...Option) (*Session, error), opts []Option) (*ReconnectingClient, error) {
+	sess, err := dial(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(ReconnectingClient)
+	c.dial = dial
+	c.opts = opts
+	c.cfg = newConfig(opts)
+	c.sess = sess
+	c.connected = true
+	c.replaced = make(chan struct{})
+	c.die = make(chan struct{})
+	go c.supervise()
+	return c, nil
+}
+
+// Session returns the current session, which may already be closed while reconnecting
+func (c *ReconnectingClient) Session() *Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sess
+}
+
+func (c *ReconnectingClient) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *ReconnectingClient) supervise() {
+	for {
+		c.mu.Lock()
+		sess := c.sess
+		c.mu.Unlock()
+
+		var err error
+		select {
+		case <-c.die:
+			return
+		case <-sess.die:
+			err = sess.closeErr.Load().(error)
+		case <-sess.chSocketReadError:
+			err = sess.socketReadError.Load().(error)
+			sess.Close()
+		case <-sess.chSocketWriteError:
+			err = sess.socketWriteError.Load().(error)
+			sess.Close()
+		}
+
+		c.mu.Lock()
+		c.connected = false
+		c.mu.Unlock()
+
+		for {
+			if sess, err = c.redial(sess, err); err != nil {
+				c.close(err)
+				return
+			}
+			if err = c.replay(sess); err == nil {
+				break
+			}
+			select {
+			case <-c.die:
+				return
+			default:
+			}
+			// the new session failed too, what's left of the buffer waits for the next
+			sess.Close()
+		}
+
+		if c.cfg.onReconnected != nil {
+			c.cfg.onReconnected(sess)
+		}
+	}
+}
+
+// replay sends the messages buffered during the gap on sess, then makes it the current session.
+// Sends run without c.mu, they block on a full send window and Read needs c.mu meanwhile.
+// On an error the unsent messages go back to the front of the buffer
+func (c *ReconnectingClient) replay(sess *Session) error {
+	for {
+		c.mu.Lock()
+		select {
+		case <-c.die:
+			c.mu.Unlock()
+			sess.Close()
+			return c.closeErr.Load().(error)
+		default:
+		}
+		// 先发缓冲的消息，保证顺序，期间Send的消息排在后面
+		sends := c.pending
+		c.pending = nil
+		if len(sends) == 0 {
+			c.sess = sess
+			c.connected = true
+			close(c.replaced)
+			c.replaced = make(chan struct{})
+			c.mu.Unlock()
+			return nil
+		}
+		c.mu.Unlock()
+
+		for i, data := range sends {
+			if _, err := sess.Send(data, Reliable); err != nil {
+				c.mu.Lock()
+				c.pending = append(sends[i:], c.pending...)
+				c.mu.Unlock()
+				return err
+			}
+		}
+	}
+}
+
+// redial dials until it succeeds, asking to resume the dropped session if it had a token
+func (c *ReconnectingClient) redial(old *Session, err error) (*Session, error) {
+	opts := c.opts
+	if old.ResumeToken() != nil {
+		opts = append(append([]Option(nil), c.opts...), WithResume(old))
+	}
+	delay := c.cfg.reconnectMinDelay
+	for attempt := 1; ; attempt++ {
+		if max := c.cfg.reconnectMaxAttempts; max > 0 && attempt > max {
+			return nil, errors.Wrapf(err, "gave up reconnecting after %d attempts", max)
+		}
+		if c.cfg.onReconnecting != nil {
+			c.cfg.onReconnecting(attempt, err)
+		}
+
+		// 随机取[delay/2, delay)，避免大量客户端同时重连
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		timer := c.cfg.clock.NewTimer(wait)
+		select {
+		case <-c.die:
+			timer.Stop()
+			return nil, c.closeErr.Load().(error)
+		case <-timer.C():
+		}
+
+		var sess *Session
+		if sess, err = c.dial(opts...); err == nil {
+			return sess, nil
+		}
+		if delay *= 2; delay > c.cfg.reconnectMaxDelay {
+			delay = c.cfg.reconnectMaxDelay
+		}
+	}
+}
+
+// Read blocks across reconnects, it only fails for errors that don't end the session
+// or once the client is closed
+func (c *ReconnectingClient) Read(b []byte) (n int, channel Channel, err error) {
+	for {
+		c.mu.Lock()
+		sess, replaced := c.sess, c.replaced
+		c.mu.Unlock()
+
+		n, channel, err = sess.Read(b)
+		if err == nil || !sess.dead() {
+			return n, channel, err
+		}
+
+		select {
+		case <-replaced:
+		case <-c.die:
+			return 0, Invalid, c.closeErr.Load().(error)
+		}
+	}
+}
+
+// Send sends on the current session. While reconnecting, reliable messages are
+// handled by the GapPolicy and unreliable ones dropped with ErrReconnecting
+func (c *ReconnectingClient) Send(data []byte, channel Channel) (int, error) {
+	for {
+		c.mu.Lock()
+		select {
+		case <-c.die:
+			c.mu.Unlock()
+			return 0, c.closeErr.Load().(error)
+		default:
+		}
+		sess, connected := c.sess, c.connected
+		c.mu.Unlock()
+
+		// a reliable Send blocks while the send window is full, c.mu isn't held for it
+		if connected {
+			n, err := sess.Send(data, channel)
+			if err == nil || !sess.dead() {
+				return n, err
+			}
+		}
+
+		c.mu.Lock()
+		if c.connected && c.sess != sess {
+			// reconnected meanwhile
+			c.mu.Unlock()
+			continue
+		}
+		n, err := c.sendGap(data, channel)
+		c.mu.Unlock()
+		return n, err
+	}
+}
+
+// sendGap applies the GapPolicy to a message sent while reconnecting, c.mu must be held
+func (c *ReconnectingClient) sendGap(data []byte, channel Channel) (int, error) {
+	select {
+	case <-c.die:
+		return 0, c.closeErr.Load().(error)
+	default:
+	}
+	if channel != Reliable || c.cfg.gapPolicy != GapBuffer || len(c.pending) >= c.cfg.gapBufferSize {
+		return 0, errors.WithStack(ErrReconnecting)
+	}
+	if len(data) > ReliableMaxMessageSize {
+		return 0, errors.WithStack(ErrMessageTooLarge)
+	}
+	c.pending = append(c.pending, append([]byte(nil), data...))
+	return len(data), nil
+}
+
+// Close stops reconnecting and closes the current session, buffered messages are discarded
+func (c *ReconnectingClient) Close() error {
+	if !c.close(errors.WithStack(ErrClosed)) {
+		return errors.WithStack(ErrClosed)
+	}
+	return nil
+}
+
+func (c *ReconnectingClient) close(err error) bool {
+	var once bool
+	c.dieOnce.Do(func() {
+		c.closeErr.Store(err)
+		close(c.die)
+		once = true
+	})
+	if !once {
+		return false
+	}
+
+	c.mu.Lock()
+	c.connected = false
+	c.pending = nil
+	sess := c.sess
+	c.mu.Unlock()
+	sess.Close()
+	return true
+}
@@ -0,0 +1,278 @@
+package kcp2k
+
+import (
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"github.com/pkg/errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// reconnecting dials l through a ReconnectingClient whose every dial uses a new conn of n.
+// before runs ahead of each dial, the first one is 0, and an error fails that dial
+func reconnecting(t *testing.T, n *netsim.Network, l *Listener, before func(dial int) error, opts ...Option) *ReconnectingClient {
+	t.Helper()
+	var mu sync.Mutex
+	var conns []net.PacketConn
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+
+	var dials int
+	c, err := dialReconnecting(func(opts ...Option) (*Session, error) {
+		// supervise dials one at a time after the first
+		dial := dials
+		dials++
+		if before != nil {
+			if err := before(dial); err != nil {
+				return nil, err
+			}
+		}
+		conn, err := n.Listen("")
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		conns = append(conns, conn)
+		mu.Unlock()
+		return DialConn(conn, l.Addr(), opts...)
+	}, append([]Option{WithLogger(discardLogger), WithReconnectBackoff(time.Millisecond, 10*time.Millisecond)}, opts...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func readReconnecting(t *testing.T, c *ReconnectingClient) string {
+	t.Helper()
+	got := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		n, _, err := c.Read(buf)
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		got <- string(buf[:n])
+	}()
+	select {
+	case s := <-got:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read timed out")
+		return ""
+	}
+}
+
+func TestReconnectAfterKick(t *testing.T) {
+	n := netsim.New(1)
+	l, lconn := serve(t, n, WithLogger(discardLogger))
+	defer lconn.Close()
+	defer l.Close()
+
+	reconnected := make(chan *Session, 1)
+	attempts := make(chan int, 16)
+	c := reconnecting(t, n, l, nil,
+		WithOnReconnecting(func(attempt int, err error) { attempts <- attempt }),
+		WithOnReconnected(func(s *Session) { reconnected <- s }))
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := c.Session()
+
+	if err := l.Kick(s.ID(), nil); err != nil {
+		t.Fatal(err)
+	}
+	s, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sess *Session
+	select {
+	case sess = <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnReconnected not called")
+	}
+	if sess == first || c.Session() != sess || !c.Connected() {
+		t.Fatal("the client didn't switch to the new session")
+	}
+	if attempt := <-attempts; attempt != 1 {
+		t.Fatalf("first reconnect attempt is %d", attempt)
+	}
+
+	// Read carries on across the reconnect
+	send(t, s, "after")
+	if got := readReconnecting(t, c); got != "after" {
+		t.Fatalf("got %q", got)
+	}
+	if _, err := c.Send([]byte("back"), Reliable); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, s); got != "back" {
+		t.Fatalf("got %q", got)
+	}
+
+	c.Close()
+	if _, err := c.Send([]byte("closed"), Reliable); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Send after Close returned %v", err)
+	}
+}
+
+// waitClock is the real clock, recording the durations ReconnectingClient waits between attempts
+type waitClock struct {
+	realClock
+	mu    sync.Mutex
+	waits []time.Duration
+}
+
+func (c *waitClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	c.waits = append(c.waits, d)
+	c.mu.Unlock()
+	return c.realClock.NewTimer(0)
+}
+
+func TestReconnectBackoffAndMaxAttempts(t *testing.T) {
+	n := netsim.New(1)
+	l, lconn := serve(t, n, WithLogger(discardLogger))
+	defer lconn.Close()
+	defer l.Close()
+
+	clock := new(waitClock)
+	refused := errors.New("refused")
+	var attempts []int
+	c := reconnecting(t, n, l, func(dial int) error {
+		if dial > 0 {
+			return refused
+		}
+		return nil
+	}, WithClock(clock), WithReconnectBackoff(100*time.Millisecond, 400*time.Millisecond), WithReconnectMaxAttempts(6),
+		WithOnReconnecting(func(attempt int, err error) { attempts = append(attempts, attempt) }))
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Kick(s.ID(), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client gives up and closes with the last dial's error
+	if got := readReconnecting(t, c); !strings.Contains(got, "gave up reconnecting after 6 attempts") || !strings.Contains(got, "refused") {
+		t.Fatalf("Read returned %q", got)
+	}
+	if _, err := c.Send([]byte("x"), Reliable); !errors.Is(err, refused) {
+		t.Fatalf("Send returned %v", err)
+	}
+	if len(attempts) != 6 || attempts[5] != 6 {
+		t.Fatalf("OnReconnecting got attempts %v", attempts)
+	}
+
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	var backoff []time.Duration
+	for _, d := range clock.waits {
+		// the client's own session may set timers too, the backoff waits are the long ones
+		if d >= 50*time.Millisecond && d <= 400*time.Millisecond {
+			backoff = append(backoff, d)
+		}
+	}
+	if len(backoff) != 6 {
+		t.Fatalf("waited %v, want 6 backoff waits", clock.waits)
+	}
+	// jittered into [delay/2, delay], doubling from 100ms up to 400ms
+	for i, max := range []time.Duration{100, 200, 400, 400, 400, 400} {
+		if max *= time.Millisecond; backoff[i] < max/2 || backoff[i] > max {
+			t.Fatalf("wait %d is %s, want between %s and %s", i+1, backoff[i], max/2, max)
+		}
+	}
+}
+
+// gap kicks the client's session and holds its reconnect until the returned func is called
+func gap(t *testing.T, n *netsim.Network, l *Listener, opts ...Option) (c *ReconnectingClient, resume func() *Session) {
+	t.Helper()
+	hold := make(chan struct{})
+	c = reconnecting(t, n, l, func(dial int) error {
+		if dial > 0 {
+			<-hold
+		}
+		return nil
+	}, opts...)
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Kick(s.ID(), nil); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the client to notice", func() bool { return !c.Connected() })
+	return c, func() *Session {
+		t.Helper()
+		close(hold)
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		eventually(t, "the reconnect", c.Connected)
+		return s
+	}
+}
+
+func TestGapDrop(t *testing.T) {
+	n := netsim.New(1)
+	l, lconn := serve(t, n, WithLogger(discardLogger))
+	defer lconn.Close()
+	defer l.Close()
+
+	c, resume := gap(t, n, l, WithGapPolicy(GapDrop, 0))
+	for _, channel := range []Channel{Reliable, Unreliable} {
+		if _, err := c.Send([]byte("gap"), channel); !errors.Is(err, ErrReconnecting) {
+			t.Fatalf("%s Send while reconnecting returned %v", channel, err)
+		}
+	}
+	s := resume()
+	if _, err := c.Send([]byte("after"), Reliable); err != nil {
+		t.Fatal(err)
+	}
+	// nothing from the gap arrives first
+	if got := readString(t, s); got != "after" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestGapBuffer(t *testing.T) {
+	n := netsim.New(1)
+	l, lconn := serve(t, n, WithLogger(discardLogger))
+	defer lconn.Close()
+	defer l.Close()
+
+	c, resume := gap(t, n, l, WithGapPolicy(GapBuffer, 2))
+	for _, msg := range []string{"one", "two"} {
+		if _, err := c.Send([]byte(msg), Reliable); err != nil {
+			t.Fatalf("buffered Send returned %v", err)
+		}
+	}
+	if _, err := c.Send([]byte("three"), Reliable); !errors.Is(err, ErrReconnecting) {
+		t.Fatalf("Send to a full buffer returned %v", err)
+	}
+	if _, err := c.Send([]byte("unreliable"), Unreliable); !errors.Is(err, ErrReconnecting) {
+		t.Fatalf("unreliable Send while reconnecting returned %v", err)
+	}
+	s := resume()
+	if _, err := c.Send([]byte("after"), Reliable); err != nil {
+		t.Fatal(err)
+	}
+	// the buffer is replayed in order ahead of later sends
+	for _, want := range []string{"one", "two", "after"} {
+		if got := readString(t, s); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package kcp2k
+
+import (
+	"encoding/binary"
+	"github.com/0990/kcp2k-go/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// Session resumption is an extension negotiated in Hello, peers that don't know it ignore the payload.
+// received is the number of reliable messages the sender got on the connection being replaced,
+// telling the peer how many of its own were lost with it
+//
+//	client hello: [helloResume] or [helloResume][token][received] to resume
+//	server hello: [helloResume][resumed][token][received]
+const (
+	helloResume     byte = 1
+	resumeTokenSize      = 16
+	resumeCountSize      = 8
+)
+
+// resumeHello is the client's Hello payload
+func resumeHello(cfg *config) []byte {
+	if cfg.resumeGrace <= 0 {
+		return nil
+	}
+	if old := cfg.resumeFrom; old != nil && len(old.resumeToken) == resumeTokenSize {
+		hello := append([]byte{helloResume}, old.resumeToken...)
+		return binary.LittleEndian.AppendUint64(hello, old.receivedMessages.Load())
+	}
+	return []byte{helloResume}
+}
+
+// parseResumeHello reads the server's Hello payload, ok is false if the server doesn't support resumption
+func parseResumeHello(data []byte) (token []byte, resumed bool, received uint64, ok bool) {
+	if len(data) != 2+resumeTokenSize+resumeCountSize || data[0] != helloResume {
+		return nil, false, 0, false
+	}
+	token = append([]byte(nil), data[2:2+resumeTokenSize]...)
+	return token, data[1] == 1, binary.LittleEndian.Uint64(data[2+resumeTokenSize:]), true
+}
+
+func (s *Session) resumeReply(resumed bool, received uint64) []byte {
+	if s.resumeToken == nil {
+		return nil
+	}
+	reply := []byte{helloResume, 0}
+	if resumed {
+		reply[1] = 1
+	}
+	reply = append(reply, s.resumeToken...)
+	return binary.LittleEndian.AppendUint64(reply, received)
+}
+
+// lost is how many of sent reliable messages the peer didn't receive
+func lost(sent, received uint64) int {
+	if received >= sent {
+		return 0
+	}
+	return int(sent - received)
+}
+
+// ResumeToken is the token the server issued at handshake, nil if either side didn't enable resumption.
+// Dial with WithResume to resume the session after it dropped
+func (s *Session) ResumeToken() []byte { return s.resumeToken }
+
+// Resumed reports whether the server resumed a suspended session instead of starting a new one.
+// Always false on the server side
+func (s *Session) Resumed() bool { return s.resumed }
+
+// ResumeLost is the number of reliable messages this side sent on the connection the last
+// resumption replaced that the peer never received. On the server it's set when OnResumed runs,
+// on a client once the resuming dial returns
+func (s *Session) ResumeLost() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resumeLost
+}
+
+func (s *Session) isSuspended() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == Suspended
+}
+
+func (s *Session) isQueuing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queuing()
+}
+
+// acceptHello handles the resumption part of a client's Hello on the server. It reports whether
+// a suspended session took over the pending session s, which must then be dropped quietly.
+// Otherwise token is the new session's resumption token, nil if the client didn't ask for one
+func (l *Listener) acceptHello(s *Session, hello []byte) (resumed bool, token []byte) {
+	if l.cfg.resumeGrace <= 0 || len(hello) == 0 || hello[0] != helloResume {
+		return false, nil
+	}
+	if len(hello) == 1+resumeTokenSize+resumeCountSize {
+		token := string(hello[1 : 1+resumeTokenSize])
+		if old, ok := l.resumable.Load(token); ok {
+			// the client may notice the outage before the server does
+			old.suspend()
+		}
+		received := binary.LittleEndian.Uint64(hello[1+resumeTokenSize:])
+		if old, ok := l.suspended.LoadAndDelete(token); ok && old.resume(s, received) {
+			return true, nil
+		}
+	}
+	// 没有可恢复的session，当作新连接
+	return false, util.RandBytes(resumeTokenSize)
+}
+
+// suspend keeps a timed out session for the grace period instead of closing it.
+// It reports false if the session can't be suspended and should be closed
+func (s *Session) suspend() bool {
+	if s.l == nil || s.resumeToken == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.die:
+		s.mu.Unlock()
+		return false
+	default:
+	}
+	if s.state != Authenticated {
+		s.mu.Unlock()
+		return false
+	}
+	s.state = Suspended
+	kcpSess := s.kcpSess // closed outside s.mu, as in close
+	s.l.sessions.CompareAndDelete(s.RemoteAddr().String(), s)
+	s.l.releaseIP(s.RemoteAddr())
+	s.l.suspended.Store(string(s.resumeToken), s)
+	s.resumeTimer = s.cfg.clock.AfterFunc(s.cfg.resumeGrace, func() {
+		if s.l.suspended.CompareAndDelete(string(s.resumeToken), s) {
+			s.disconnect(reasonTimeout, Timeout, errors.Wrap(ErrTimeout, "not resumed in time"))
+		}
+	})
+	s.mu.Unlock()
+	// 旧连接上未确认的可靠消息就此丢失
+	kcpSess.Close()
+
+	s.l.metrics.suspensions.Add(1)
+	if s.cfg.onSuspended != nil {
+		s.cfg.onSuspended(s)
+	}
+	return true
+}
+
+// resume moves the transport of the pending session p, which presented s's token, into s.
+// received is how many of s's reliable messages the client got before the outage
+func (s *Session) resume(p *Session, received uint64) bool {
+	s.mu.Lock()
+	select {
+	case <-s.die:
+		s.mu.Unlock()
+		return false
+	default:
+	}
+
+	// p is closed here instead of by close, which would close the kcp session s takes over
+	l := s.l
+	p.mu.Lock()
+	var took bool
+	p.dieOnce.Do(func() {
+		p.closeErr.Store(errors.WithStack(ErrClosed))
+		close(p.die)
+		close(p.chTxStop)
+		took = true
+	})
+	if !took {
+		// p's close already released its slots. s stays suspended, its timer may have fired
+		// while it was out of the table so the grace starts over
+		p.mu.Unlock()
+		l.suspended.Store(string(s.resumeToken), s)
+		s.resumeTimer.Reset(s.cfg.resumeGrace)
+		s.mu.Unlock()
+		return false
+	}
+	kcpSess := p.kcpSess
+	p.kcpSess = nil // p 的 kcp 连接归 s 所有
+	// released like close does, then s holds the address and IP p had
+	l.removeSession(p, p.state)
+	p.mu.Unlock()
+	s.resumeTimer.Stop()
+	l.sessions.Store(p.RemoteAddr().String(), s)
+	l.holdIP(p.RemoteAddr())
+
+	s.kcpSess = kcpSess
+	s.endpoint.Store(p.endpoint.Load())
+	s.state = Authenticated
+	now := s.cfg.clock.Now().UnixNano()
+	s.lastReceiveTime.Store(now)
+	s.lastDataTime.Store(now)
+	// the counts start over with the new connection
+	s.resumeLost = lost(s.sentMessages.Swap(0), received)
+	reply := s.resumeReply(true, s.receivedMessages.Swap(0))
+	// Hello goes before any Send, the new kcp session's send window is empty so it can't block
+	writeReliable(kcpSess, Hello, reply)
+	sends := s.suspendedSends
+	if sends != nil {
+		// reliable Sends keep queueing behind the replay
+		s.suspendedSends = [][]byte{}
+	}
+	s.mu.Unlock()
+
+	go s.readKcpLoop()
+	go s.pingLoop()
+
+	l.metrics.resumptions.Add(1)
+	if s.cfg.onResumed != nil {
+		s.cfg.onResumed(s)
+	}
+	s.replaySuspended(sends)
+	return true
+}
+
+// replaySuspended sends what was buffered while suspended, and what Send queued behind it
+// meanwhile, until the buffer is empty. It runs without s.mu: kcp's Write blocks on a full send
+// window until acks arrive, and the listener needs s.mu to pass them on
+func (s *Session) replaySuspended(sends [][]byte) {
+	for len(sends) > 0 {
+		for i, data := range sends {
+			if _, err := s.sendReliable(Data, data); err != nil {
+				// closed, or suspended again and the rest waits for the next resume
+				s.mu.Lock()
+				s.suspendedSends = append(sends[i:], s.suspendedSends...)
+				s.mu.Unlock()
+				return
+			}
+		}
+
+		s.mu.Lock()
+		sends = s.suspendedSends
+		if len(sends) == 0 {
+			s.suspendedSends = nil
+		} else {
+			s.suspendedSends = [][]byte{}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// queuing reports whether reliable messages go to suspendedSends: the session is suspended,
+// or a resume is still replaying them. s.mu must be held
+func (s *Session) queuing() bool {
+	return s.state == Suspended || s.suspendedSends != nil
+}
+
+// sendSuspended buffers reliable messages until the session is resumed, s.mu must be held
+func (s *Session) sendSuspended(data []byte, channel Channel) (int, error) {
+	if channel != Reliable || len(s.suspendedSends) >= s.cfg.gapBufferSize {
+		return 0, errors.WithStack(ErrSuspended)
+	}
+	if len(data) > ReliableMaxMessageSize {
+		return 0, errors.WithStack(ErrMessageTooLarge)
+	}
+	s.suspendedSends = append(s.suspendedSends, append([]byte(nil), data...))
+	return len(data), nil
+}
@@ -0,0 +1,193 @@
+package kcp2k
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"github.com/pkg/errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// eventually polls cond for up to 5s
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func readString(t *testing.T, s *Session) string {
+	t.Helper()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := s.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func send(t *testing.T, s *Session, msg string) {
+	t.Helper()
+	if _, err := s.Send([]byte(msg), Reliable); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// suspendedPair accepts a resumable session and suspends it by cutting the link both ways,
+// after the client received a and b and the server x
+func suspendedPair(t *testing.T, opts ...Option) (n *netsim.Network, l *Listener, s, c *Session) {
+	n = netsim.New(1)
+	l, lconn := serve(t, n, append([]Option{WithResumption(time.Minute),
+		WithPingInterval(10 * time.Millisecond), WithPingTimeout(100 * time.Millisecond)}, opts...)...)
+	t.Cleanup(func() { l.Close() })
+
+	c, cconn := dial(t, n, l, WithResumption(1))
+	t.Cleanup(c.Close)
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(t, s, "a")
+	send(t, s, "b")
+	send(t, c, "x")
+	readString(t, c)
+	readString(t, c)
+	readString(t, s)
+
+	n.SetLink(lconn.LocalAddr(), cconn.LocalAddr(), netsim.Link{Loss: 1})
+	n.SetLink(cconn.LocalAddr(), lconn.LocalAddr(), netsim.Link{Loss: 1})
+	send(t, s, "c")
+	send(t, c, "y")
+	c.Close()
+	eventually(t, "the suspension", func() bool { return l.Metrics().Suspensions == 1 })
+	return n, l, s, c
+}
+
+func TestResumeReportsLostMessages(t *testing.T) {
+	resumed := make(chan int, 1)
+	n, l, s, old := suspendedPair(t, WithOnResumed(func(s *Session) { resumed <- s.ResumeLost() }))
+	send(t, s, "while away")
+
+	c, _ := dial(t, n, l, WithResumption(1), WithResume(old))
+	defer c.Close()
+	if !c.Resumed() {
+		t.Fatal("not resumed")
+	}
+	if got := <-resumed; got != 1 {
+		t.Fatalf("server ResumeLost %d, want 1 for c", got)
+	}
+	if got := c.ResumeLost(); got != 1 {
+		t.Fatalf("client ResumeLost %d, want 1 for y", got)
+	}
+	if got := readString(t, c); got != "while away" {
+		t.Fatalf("client got %q, want the message sent while suspended", got)
+	}
+	if m := l.Metrics(); l.sessionCount.Load() != 1 || m.PendingHandshakes != 0 || m.ActiveSessions != 1 {
+		t.Fatalf("%d sessions after the resume: %+v", l.sessionCount.Load(), m)
+	}
+}
+
+// TestResumeByClosedPendingSession resumes with a pending session that closed meanwhile,
+// which released its own slots
+func TestResumeByClosedPendingSession(t *testing.T) {
+	_, l, s, _ := suspendedPair(t)
+	addr := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 1}
+	p := l.newPendingSession(addr.String(), addr)
+	p.Close()
+
+	// as acceptHello does
+	token := string(s.resumeToken)
+	if old, _ := l.suspended.LoadAndDelete(token); old != s || s.resume(p, 0) {
+		t.Fatal("resumed by a closed session")
+	}
+	if l.sessionCount.Load() != 1 || l.Metrics().PendingHandshakes != 0 {
+		t.Fatalf("%d sessions and %d pending handshakes, want the suspended one only",
+			l.sessionCount.Load(), l.Metrics().PendingHandshakes)
+	}
+	if old, _ := l.suspended.Load(token); old != s || !s.isSuspended() {
+		t.Fatal("the session is no longer suspended")
+	}
+}
+
+func TestResumeReplaysInOrder(t *testing.T) {
+	resumed := make(chan struct{})
+	n, l, s, old := suspendedPair(t, WithOnResumed(func(s *Session) {
+		// queued behind the replay
+		s.Send([]byte("after"), Reliable)
+		close(resumed)
+	}))
+
+	// more than kcp's send window, which would block the replay if it held s.mu
+	const buffered = 3 * kcpWndRcv
+	for i := 0; i < buffered; i++ {
+		send(t, s, fmt.Sprint(i))
+	}
+
+	c, _ := dial(t, n, l, WithResumption(1), WithResume(old))
+	defer c.Close()
+	<-resumed
+	for i := 0; i < buffered; i++ {
+		if got := readString(t, c); got != fmt.Sprint(i) {
+			t.Fatalf("message %d is %q", i, got)
+		}
+	}
+	if got := readString(t, c); got != "after" {
+		t.Fatalf("got %q, want the message sent from OnResumed last", got)
+	}
+}
+
+// forgedServer answers every Hello with a server Hello that claims to resume the session of token
+func forgedServer(t *testing.T, n *netsim.Network, token []byte) net.Addr {
+	t.Helper()
+	conn, err := n.Listen("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	hello := append([]byte{byte(Hello), helloResume, 1}, token...)
+	hello = binary.LittleEndian.AppendUint64(hello, 0)
+	go func() {
+		buf := make([]byte, mtuLimit)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < headerSize+kcpOverhead || Channel(buf[0]) != Reliable {
+				continue
+			}
+			conv := binary.LittleEndian.Uint32(buf[headerSize:])
+			conn.WriteTo(append([]byte{byte(Reliable), 1, 2, 3, 4}, kcpSegment(conv, kcpCmdPush, 0, hello)...), addr)
+		}
+	}()
+	return conn.LocalAddr()
+}
+
+func TestForgedResumedHelloFailsHandshake(t *testing.T) {
+	token := bytes.Repeat([]byte{7}, resumeTokenSize)
+	old := &Session{resumeToken: bytes.Repeat([]byte{8}, resumeTokenSize)}
+	for name, opts := range map[string][]Option{
+		"no resume asked":   {WithResumption(1)},
+		"other token":       {WithResumption(1), WithResume(old)},
+		"resumption is off": {WithResume(&Session{resumeToken: token})},
+	} {
+		n := netsim.New(1)
+		conn, err := n.Listen("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, err = DialConn(conn, forgedServer(t, n, token), append(opts, WithLogger(discardLogger), WithHandshakeTimeout(time.Second))...)
+		if handshakeFailReason(err) != HandshakeInvalidHello || !errors.Is(err, ErrHandshake) {
+			t.Errorf("%s: dial returned %v, want an invalid hello", name, err)
+		}
+	}
+}
@@ -1,14 +1,53 @@
 package kcp2k
 
-import "github.com/pkg/errors"
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+)
 
 func (s *Session) sendLoop() {
-	for tx := range s.chTxQueue {
-		if _, err := s.conn.WriteTo(tx.Buffers[0], tx.Addr); err == nil {
-			xmitBuf.Put(tx.Buffers[0])
-		} else {
-			s.notifyWriteError(errors.WithStack(err))
-			break
+	defer close(s.chTxDone)
+
+	for {
+		select {
+		case tx := <-s.chTxQueue:
+			if !s.write(tx) {
+				return
+			}
+		case <-s.chTxStop:
+			// flush what close queued, e.g. the Disconnect message
+			for {
+				select {
+				case tx := <-s.chTxQueue:
+					if !s.write(tx) {
+						return
+					}
+				default:
+					return
+				}
+			}
 		}
 	}
 }
+
+func (s *Session) write(tx ipv4.Message) bool {
+	n, err := s.conn.WriteTo(tx.Buffers[0], tx.Addr)
+	if err != nil {
+		s.notifyWriteError(errors.WithStack(err))
+		return false
+	}
+	if s.l != nil {
+		s.l.metrics.countOut(Channel(tx.Buffers[0][0]), n)
+	}
+	xmitBuf.Put(tx.Buffers[0])
+	return true
+}
+
+// enqueue hands a datagram to sendLoop, or drops it once sendLoop has exited
+func (s *Session) enqueue(msg ipv4.Message) {
+	select {
+	case s.chTxQueue <- msg:
+	case <-s.chTxDone:
+		xmitBuf.Put(msg.Buffers[0])
+	}
+}
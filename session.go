@@ -2,13 +2,14 @@ package kcp2k
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"github.com/0990/kcp-go"
 	"github.com/pkg/errors"
 	"golang.org/x/net/ipv4"
-	"io"
 	"log/slog"
 	"net"
 	"sync"
@@ -22,6 +23,7 @@ const (
 	Connected Kcp2kState = iota
 	Authenticated
 	Disconnected
+	Suspended // timed out, kept for the client to resume
 )
 
 var (
@@ -37,24 +39,35 @@ func init() {
 	}
 }
 
+// Session is one kcp2k connection. Read, Send, Close, SetReadDeadline and the Set*Timeout
+// methods are safe for concurrent use. Concurrent Reads each get whole messages, except that
+// the rest of a reliable message larger than b goes to whichever Read comes next
 type Session struct {
-	state Kcp2kState
+	id    uint64
+	state Kcp2kState // guarded by mu
 
 	conn    net.PacketConn // the underlying packet connection
 	ownConn bool           // true if we created conn internally, false if provided by caller
 
-	remote  net.Addr
-	l       *Listener
-	kcpSess *kcp.UDPSession
-	cookie  []byte
+	endpoint atomic.Pointer[endpoint]
+	l        *Listener
+	mux      *Multiplexer
+	cfg      *config
+	kcpSess  *kcp.UDPSession // guarded by mu, swapped by resume
 
 	//当session为客户端时有值
 	kcpConn *KcpUnderlyingConn
 
-	rd     time.Time // read deadline
-	bufptr []byte
+	rd     atomic.Value // read deadline for Read()
+	bufptr []byte       // guarded by mu
 
-	lastReceiveTime     time.Time
+	lastReceiveTime     atomic.Int64 // unix nano of the last datagram with a valid cookie
+	lastDataTime        atomic.Int64 // unix nano of the last message on either channel
+	pingInterval        atomic.Int64
+	pingTimeout         atomic.Int64
+	idleTimeout         atomic.Int64
+	limiters            [channelCount]*inboundLimiter
+	groups              map[*Group]struct{} // guarded by mu
 	chUnReliableReadMsg chan []byte
 	chReliableReadMsg   chan []byte
 
@@ -68,68 +81,126 @@ type Session struct {
 	socketReadErrorOnce  sync.Once
 	socketWriteErrorOnce sync.Once
 
-	die     chan struct{} // notify current session has Closed
-	dieOnce sync.Once
+	resumeToken    []byte
+	resumed        bool
+	resumeTimer    Timer
+	resumeLost     int      // guarded by mu
+	suspendedSends [][]byte // reliable messages sent while suspended, guarded by mu
+
+	// reliable messages on the current kcp session, for resumption to tell what was lost
+	sentMessages     atomic.Uint64
+	receivedMessages atomic.Uint64
+
+	die      chan struct{} // notify current session has Closed
+	dieOnce  sync.Once
+	closeErr atomic.Value // error returned by Read and Send once closed
 
 	chTxQueue chan ipv4.Message
+	chTxStop  chan struct{} // closed by close once nothing more will be queued
+	chTxDone  chan struct{} // closed when sendLoop exits
+
+	readLoopDone chan struct{} // closed when a dialled session's own readLoop exits
 
-	lastPingReceiveTime atomic.Value
+	mu  sync.Mutex
+	wmu sync.Mutex // serializes writeNoWait, which sets and clears the kcp write deadline
+}
 
-	mu sync.Mutex
+// endpoint is where the send path writes to. It is replaced whole when a client learns its
+// cookie or a session is resumed, so sends read it without taking mu
+type endpoint struct {
+	addr   net.Addr
+	cookie []byte
 }
 
-func DialWithOptions(raddr string) (*Session, error) {
+func DialWithOptions(raddr string, opts ...Option) (*Session, error) {
+	cfg := newConfig(opts)
 	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, errors.WithStack(&DisconnectError{Code: DnsResolve, Err: err})
+	}
+	var laddr *net.UDPAddr
+	if cfg.localAddr != "" {
+		if laddr, err = net.ResolveUDPAddr("udp", cfg.localAddr); err != nil {
+			return nil, errors.WithStack(&DisconnectError{Code: DnsResolve, Err: err})
+		}
 	}
 	//这里使用ListenUDP,建立一个无连接的udp连接，方便tx发送时能使用WriteToUDP
-	conn, err := net.ListenUDP("udp", nil)
+	conn, err := net.ListenUDP("udp", laddr)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
+	return dialConn(conn, true, udpaddr, cfg, nil)
+}
+
+// DialConn dials raddr over a caller-provided conn, such as an already hole-punched socket
+// or a simulated net.PacketConn. conn is not closed when the session closes
+func DialConn(conn net.PacketConn, raddr net.Addr, opts ...Option) (*Session, error) {
+	return dialConn(conn, false, raddr, newConfig(opts), nil)
+}
+
+// dialConn handshakes a client session over conn. Datagrams are read by the
+// session's own readLoop, or by mux when the socket is shared
+func dialConn(conn net.PacketConn, ownConn bool, raddr net.Addr, cfg *config, mux *Multiplexer) (*Session, error) {
 	var convid uint32
 	binary.Read(rand.Reader, binary.LittleEndian, &convid)
-	s := newSession(nil, nil, conn, true, udpaddr)
+	s := newSession(nil, nil, conn, ownConn, raddr, cfg)
+	if mux != nil {
+		if !mux.add(s) {
+			s.Close()
+			return nil, errors.Errorf("already dialled %s", raddr)
+		}
+	} else {
+		s.readLoopDone = make(chan struct{})
+		go s.readLoop()
+	}
 
 	s.kcpConn = newKcpUnderlyingConn(conn, func(addr net.Addr) (KCPOutput, error) {
 		return s, nil
 	})
 
-	kcpSess, err := kcp.NewConn3(convid, udpaddr, nil, 0, 0, s.kcpConn)
+	kcpSess, err := kcp.NewConn3(convid, raddr, nil, 0, 0, s.kcpConn)
 	if err != nil {
-		return nil, err
+		s.Close()
+		return nil, errors.WithStack(err)
 	}
 	ok := s.SetKcpSession(kcpSess)
 	if !ok {
-		return nil, err
+		s.Close()
+		return nil, errors.WithStack(errInvalidOperation)
 	}
-	s.sendReliable(Hello, nil)
+	s.sendReliable(Hello, resumeHello(cfg))
 
 	err = s.Run()
 	if err != nil {
+		s.handshakeFailed(err)
+		s.waitReadLoop()
 		return nil, err
 	}
 	return s, nil
 }
 
-func newSession(cookie []byte, l *Listener, conn net.PacketConn, ownConn bool, addr net.Addr) *Session {
+func newSession(cookie []byte, l *Listener, conn net.PacketConn, ownConn bool, addr net.Addr, cfg *config) *Session {
 	s := new(Session)
 	s.l = l
+	s.cfg = cfg
 	s.conn = conn
 	s.ownConn = ownConn
-	s.cookie = cookie
-	s.remote = addr
+	s.endpoint.Store(&endpoint{addr: addr, cookie: cookie})
 	s.chAcceptKCPEvent = make(chan struct{}, 1)
 	s.die = make(chan struct{})
 	s.chSocketReadError = make(chan struct{})
+	s.chSocketWriteError = make(chan struct{})
 	s.chUnReliableReadMsg = make(chan []byte, 10)
 	s.chReliableReadMsg = make(chan []byte, 10)
 	s.chTxQueue = make(chan ipv4.Message, 10)
-
-	if s.l == nil {
-		go s.readLoop()
+	s.chTxStop = make(chan struct{})
+	s.chTxDone = make(chan struct{})
+	s.pingInterval.Store(int64(cfg.pingInterval))
+	s.pingTimeout.Store(int64(cfg.pingTimeout))
+	s.idleTimeout.Store(int64(cfg.idleTimeout))
+	for c := range cfg.rateLimits {
+		s.limiters[c] = newInboundLimiter(Channel(c), cfg.rateLimits[c])
 	}
 
 	go s.sendLoop()
@@ -145,36 +216,148 @@ func (s *Session) SetState(state Kcp2kState) {
 // 握手并接受数据
 func (s *Session) Run() error {
 	//握手
-	s.kcpSess.SetReadDeadline(time.Now().Add(time.Second * 5))
-	packet, err := ReadPacket(s.kcpSess)
+	packet, err := s.readHello()
 	if err != nil {
-		return err
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return handshakeError(HandshakeTimeout, ErrTimeout)
+		}
+		return handshakeError(HandshakeAborted, err)
 	}
-	s.kcpSess.SetReadDeadline(time.Time{})
 
-	opCode, _, err := parseKcp2kBodyData(packet)
+	opCode, hello, err := parseKcp2kBodyData(packet)
 	if err != nil {
-		return err
+		return handshakeError(HandshakeWrongOpcode, err)
 	}
 
 	if opCode != Hello {
-		return errors.New("not hello")
+		return handshakeError(HandshakeWrongOpcode, fmt.Errorf("first opcode %d is not hello", opCode))
 	}
 
-	s.SetState(Authenticated)
+	var token []byte
 	if s.l != nil {
-		s.l.chAccepts <- s
-		s.sendReliable(Hello, nil)
+		var resumed bool
+		if resumed, token = s.l.acceptHello(s, hello); resumed {
+			return nil
+		}
+	} else {
+		var received uint64
+		token, s.resumed, received, _ = parseResumeHello(hello)
+		if s.resumed {
+			old := s.cfg.resumeFrom
+			if s.cfg.resumeGrace <= 0 || old == nil || !bytes.Equal(old.resumeToken, token) {
+				return handshakeError(HandshakeInvalidHello, errors.New("resumed a session the client didn't ask to resume"))
+			}
+			s.resumeLost = lost(old.sentMessages.Load(), received)
+		}
 	}
 
-	s.lastPingReceiveTime.Store(time.Now())
+	if !s.authenticate(token) {
+		return handshakeError(HandshakeAborted, ErrClosed)
+	}
+	if s.l != nil {
+		s.l.pendingHandshakes.Add(-1)
+		s.l.metrics.activeSessions.Add(1)
+		s.l.metrics.handshakesAccepted.Add(1)
+		select {
+		case s.l.chAccepts <- s:
+		case <-s.l.die:
+			return handshakeError(HandshakeAborted, ErrClosed)
+		}
+		s.sendReliable(Hello, s.resumeReply(false, 0))
+	}
+
+	now := s.cfg.clock.Now().UnixNano()
+	s.lastReceiveTime.Store(now)
+	s.lastDataTime.Store(now)
 	go s.readKcpLoop()
 	go s.pingLoop()
 
 	return nil
 }
 
-func (s *Session) RemoteAddr() net.Addr { return s.remote }
+// readHello reads the first kcp message within the handshake timeout. kcp-go deadlines only
+// know the real time, so the timeout runs on cfg.clock and then expires the read at once
+func (s *Session) readHello() ([]byte, error) {
+	var mu sync.Mutex
+	var done bool
+	timer := s.cfg.clock.AfterFunc(s.cfg.handshakeTimeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !done {
+			s.kcpSess.SetReadDeadline(time.Now())
+		}
+	})
+	defer timer.Stop()
+
+	packet, err := ReadPacket(s.kcpSess)
+
+	mu.Lock()
+	done = true
+	mu.Unlock()
+	s.kcpSess.SetReadDeadline(time.Time{})
+	return packet, err
+}
+
+// authenticate moves the session to Authenticated with its resumption token unless it was
+// closed during the handshake. The token is set under s.mu, removeSession reads it on close
+func (s *Session) authenticate(token []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.die:
+		return false
+	default:
+	}
+	s.state = Authenticated
+	s.resumeToken = token
+	if s.l != nil {
+		s.l.sessionsByID.Store(s.id, s)
+		if s.resumeToken != nil {
+			s.l.resumable.Store(string(s.resumeToken), s)
+		}
+	}
+	return true
+}
+
+// ID identifies a session accepted by a Listener, it starts at 1 and never repeats within the
+// listener's lifetime. Dialled sessions have ID 0
+func (s *Session) ID() uint64 { return s.id }
+
+func (s *Session) RemoteAddr() net.Addr { return s.endpoint.Load().addr }
+
+func (s *Session) cookie() []byte { return s.endpoint.Load().cookie }
+
+// RTT is kcp's smoothed round-trip time, 0 until the peer acknowledged something
+func (s *Session) RTT() time.Duration {
+	kcpSess := s.kcpSession()
+	if kcpSess == nil {
+		return 0
+	}
+	return time.Duration(kcpSess.GetSRTT()) * time.Millisecond
+}
+
+// SetReadDeadline sets the deadline for future Read calls, a zero t disables it
+func (s *Session) SetReadDeadline(t time.Time) error {
+	s.rd.Store(t)
+	return nil
+}
+
+func loadDuration(d *atomic.Int64) time.Duration { return time.Duration(d.Load()) }
+func loadTime(t *atomic.Int64) time.Time         { return time.Unix(0, t.Load()) }
+
+// logger returns the configured logger with this session's attributes attached
+func (s *Session) logger() *slog.Logger {
+	kcpSess := s.kcpSession()
+	args := []any{"remote", s.RemoteAddr().String(), "cookie", hex.EncodeToString(s.cookie())}
+	if s.id != 0 {
+		args = append(args, "id", s.id)
+	}
+	if kcpSess != nil {
+		args = append(args, "conv", kcpSess.GetConv())
+	}
+	return s.cfg.logger.With(args...)
+}
 
 func (c *Session) SetKcpSession(sess *kcp.UDPSession) bool {
 	c.mu.Lock()
@@ -193,72 +376,207 @@ func (c *Session) SetKcpSession(sess *kcp.UDPSession) bool {
 
 func (s *Session) WaitAcceptKCP(cb func(error)) {
 	go func() {
+		timer := s.cfg.clock.NewTimer(s.cfg.handshakeTimeout)
+		defer timer.Stop()
+
 		select {
 		case <-s.chAcceptKCPEvent:
 			cb(nil)
 			return
-		case <-time.After(time.Second * 5):
-			cb(errTimeout)
+		case <-s.die:
+			return
+		case <-timer.C():
+			cb(handshakeError(HandshakeTimeout, ErrTimeout))
 			return
 		}
 	}()
 }
 
+// Close closes the session. A conn passed to DialConn is left open and free to reuse once it returns
 func (s *Session) Close() {
+	s.close(reasonClosed, errors.WithStack(ErrClosed))
+	s.waitReadLoop()
+}
+
+// waitReadLoop waits for readLoop to let go of the caller's conn
+func (s *Session) waitReadLoop() {
+	if s.readLoopDone != nil && !s.ownConn {
+		<-s.readLoopDone
+	}
+}
+
+// close tears the session down once, err is what Read and Send return from then on.
+// It reports whether this call closed the session
+func (s *Session) close(reason disconnectReason, err error) bool {
 	var once bool
 	s.dieOnce.Do(func() {
+		s.closeErr.Store(err)
 		close(s.die)
 		once = true
 	})
 
-	if once {
-		s.mu.Lock()
-		defer s.mu.Unlock()
+	if !once {
+		return false
+	}
 
-		if s.kcpSess != nil {
-			s.kcpSess.Close()
+	// die is closed, so resume and suspend leave kcpSess and state alone from here on
+	s.mu.Lock()
+	kcpSess := s.kcpSess
+	sayBye := s.state == Authenticated && reason != reasonRemote
+	s.mu.Unlock()
+	if kcpSess != nil {
+		if sayBye {
+			// tell the peer, kcp flushes it on Close. A peer that stopped acking, as on a
+			// ping timeout, fills the send window and Disconnect is dropped rather than wait
+			s.writeNoWait(kcpSess, []byte{byte(Disconnect)})
 		}
-		if s.l != nil {
-			s.l.sessions.Delete(s.remote.String())
+		kcpSess.Close()
+	}
+
+	s.mu.Lock()
+	if s.kcpConn != nil {
+		// stops kcp-go's reader of a dialled session
+		s.kcpConn.notifyReadError(errors.WithStack(ErrClosed))
+	}
+	close(s.chTxStop)
+	if s.mux != nil {
+		s.mux.sessions.CompareAndDelete(s.RemoteAddr().String(), s)
+	}
+	if s.l != nil {
+		s.l.removeSession(s, s.state)
+		if s.state != Connected {
+			s.l.metrics.activeSessions.Add(-1)
+			s.l.metrics.disconnects[reason].Add(1)
 		}
 	}
+	// die is closed, Join adds no group after this snapshot
+	groups := s.groups
+	s.groups = nil
+	s.mu.Unlock()
+
+	// outside s.mu, a group is locked before its sessions
+	for g := range groups {
+		g.remove(s)
+	}
+
+	// the socket goes last, after sendLoop flushed the Disconnect message
+	<-s.chTxDone
+	if s.ownConn {
+		s.conn.Close()
+	} else if s.l == nil && s.mux == nil {
+		// wake readLoop on the caller's conn, it clears the deadline on its way out
+		s.conn.SetReadDeadline(time.Now())
+	}
+	return true
 }
 
 func (s *Session) CheckCookie(cookie []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.l == nil && s.cookie == nil {
-		s.cookie = cookie
+	e := s.endpoint.Load()
+	if s.l == nil && e.cookie == nil {
+		// cookie belongs to the read loop's buffer
+		e = &endpoint{addr: e.addr, cookie: append([]byte(nil), cookie...)}
+		s.endpoint.Store(e)
 	}
 
 	if s.state == Authenticated {
-		if !bytes.Equal(cookie, s.cookie) {
-			return fmt.Errorf("Invalid cookie,expected:%s,actual:%s", string(s.cookie), cookie)
+		if !bytes.Equal(cookie, e.cookie) {
+			return errors.WithStack(fmt.Errorf("%w: expected %x, actual %x", ErrInvalidCookie, e.cookie, cookie))
 		}
+	} else if s.l != nil && !bytes.Equal(cookie, zeroCookie) && !bytes.Equal(cookie, e.cookie) {
+		// during the handshake a client sends a zero cookie until it learns ours
+		return errors.WithStack(fmt.Errorf("%w: expected %x, actual %x", ErrInvalidCookie, e.cookie, cookie))
 	}
 
 	return nil
 }
 
+// dead reports whether the session is closed or its socket failed
+func (s *Session) dead() bool {
+	return s.deadError() != nil
+}
+
+// deadError returns the error that ended the session, nil while it's alive.
+// The close error wins, it's the DisconnectError when the peer went away
+func (s *Session) deadError() error {
+	select {
+	case <-s.die:
+		return s.closeErr.Load().(error)
+	default:
+	}
+	select {
+	case <-s.chSocketReadError:
+		return s.socketReadError.Load().(error)
+	case <-s.chSocketWriteError:
+		return s.socketWriteError.Load().(error)
+	default:
+		return nil
+	}
+}
+
+func (s *Session) kcpSession() *kcp.UDPSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kcpSess
+}
+
+// replaced reports whether kcpSess was closed by a suspension or swapped out by a resume
+func (s *Session) replaced(kcpSess *kcp.UDPSession) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == Suspended || s.kcpSess != kcpSess
+}
+
+// isPending reports whether the session is still in the handshake
+func (s *Session) isPending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == Connected
+}
+
+func (s *Session) isAuthenticated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state == Authenticated
+}
+
+// putHeader writes the kcp2k header, with a zero cookie while a client hasn't learned it yet
+func putHeader(bts []byte, channel Channel, cookie []byte) {
+	bts[0] = byte(channel)
+	n := copy(bts[1:headerSize], cookie)
+	clear(bts[1+n : headerSize])
+}
+
 // 读不可靠消息流
 func (s *Session) onRawInputUnreliable(data []byte) {
-	if s.state == Authenticated {
-		s.chUnReliableReadMsg <- data
-		s.lastReceiveTime = time.Now()
+	if s.isAuthenticated() {
+		if ok, _ := s.allowInbound(Unreliable, len(data)); !ok {
+			return
+		}
+		// data belongs to the read loop's buffer
+		msg := xmitBuf.Get().([]byte)[:len(data)]
+		copy(msg, data)
+		select {
+		case s.chUnReliableReadMsg <- msg:
+		default:
+			xmitBuf.Put(msg)
+			if s.l != nil {
+				s.l.metrics.queueDrops.Add(1)
+			}
+		}
+		s.lastDataTime.Store(s.cfg.clock.Now().UnixNano())
 	} else {
-		slog.Warn("Received unauthenticated data")
+		s.cfg.warnLimiter.warn(s.logger(), "Received unauthenticated data")
 	}
 }
 
 func (s *Session) Read(b []byte) (n int, channel Channel, err error) {
-	var timeout *time.Timer
 	// deadline for current reading operation
-	var c <-chan time.Time
-	if !s.rd.IsZero() {
-		delay := time.Until(s.rd)
-		timeout = time.NewTimer(delay)
-		c = timeout.C
+	rd, _ := s.rd.Load().(time.Time)
+	timeout, c := deadlineTimer(s.cfg.clock, rd)
+	if timeout != nil {
 		defer timeout.Stop()
 	}
 
@@ -281,27 +599,41 @@ func (s *Session) Read(b []byte) (n int, channel Channel, err error) {
 			return n, Reliable, nil
 		case msg := <-s.chUnReliableReadMsg:
 			if len(msg) > len(b) {
-				return 0, Invalid, errors.New("buffer too small")
+				xmitBuf.Put(msg)
+				return 0, Invalid, errors.WithStack(ErrBufferTooSmall)
 			}
 			n = copy(b, msg)
+			xmitBuf.Put(msg)
 			return n, Unreliable, nil
 		case <-c:
-			return 0, Invalid, errors.WithStack(errTimeout)
+			return 0, Invalid, errors.WithStack(ErrTimeout)
 		case <-s.chSocketReadError:
-			return 0, Invalid, s.socketReadError.Load().(error)
+		case <-s.chSocketWriteError:
 		case <-s.die:
-			return 0, Invalid, errors.WithStack(io.ErrClosedPipe)
 		}
+
+		// the session ended, messages received before that are still delivered
+		if len(s.chReliableReadMsg) > 0 || len(s.chUnReliableReadMsg) > 0 {
+			continue
+		}
+		return 0, Invalid, s.deadError()
 	}
 }
 
 // 读kcp可靠消息流：listener read raw->kcp input->readKcpLoop
 func (s *Session) readKcpLoop() {
+	kcpSess := s.kcpSession()
 	go func() {
 		for {
-			data, err := ReadPacket(s.kcpSess)
+			data, err := ReadPacket(kcpSess)
 			if err != nil {
-				s.notifyReadError(err)
+				select {
+				case <-s.die:
+				default:
+					if !s.replaced(kcpSess) {
+						s.notifyReadError(errors.WithStack(err))
+					}
+				}
 				return
 			}
 			err = s.handleKCPRawData(data)
@@ -316,34 +648,65 @@ func (s *Session) readKcpLoop() {
 func (s *Session) handleKCPRawData(rawData []byte) error {
 	opCode, data, err := parseKcp2kBodyData(rawData)
 	if err != nil {
-		return err
+		return s.disconnect(reasonProtocol, InvalidReceive, err)
 	}
 
 	switch opCode {
 	case Hello:
-		s.Close()
-		return errors.New("invalid hello message")
+		return s.disconnect(reasonProtocol, InvalidReceive, errors.New("invalid hello message"))
 	case Ping:
-		slog.Debug("recv ping")
-		s.lastPingReceiveTime.Store(time.Now())
+		if s.cfg.logger.Enabled(context.Background(), slog.LevelDebug) {
+			s.logger().Debug("recv ping")
+		}
 		return nil
 	case Data:
-		s.chReliableReadMsg <- data
+		s.receivedMessages.Add(1)
+		if ok, err := s.allowInbound(Reliable, len(data)); !ok {
+			return err
+		}
+		s.lastDataTime.Store(s.cfg.clock.Now().UnixNano())
+		select {
+		case s.chReliableReadMsg <- data:
+		case <-s.die:
+		}
 		return nil
 	case Disconnect:
-		s.Close()
-		return errors.WithStack(io.ErrClosedPipe)
+		return s.disconnect(reasonRemote, ConnectionClosed, ErrClosed)
 	default:
-		s.Close()
-		return errors.WithStack(io.ErrClosedPipe)
+		return s.disconnect(reasonProtocol, InvalidReceive, fmt.Errorf("invalid opcode %d", opCode))
 	}
 }
 
+// disconnect closes the session with a DisconnectError and returns it
+func (s *Session) disconnect(reason disconnectReason, code ErrorCode, err error) error {
+	derr := errors.WithStack(&DisconnectError{Code: code, Err: err})
+	s.close(reason, derr)
+	return derr
+}
+
+// Send never blocks on a dead session, it returns the error that ended it
 func (s *Session) Send(data []byte, channel Channel) (int, error) {
+	if err := s.deadError(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	if s.state == Suspended || channel == Reliable && s.queuing() {
+		defer s.mu.Unlock()
+		return s.sendSuspended(data, channel)
+	}
+	s.mu.Unlock()
+
 	switch channel {
 	case Reliable:
+		if len(data) > ReliableMaxMessageSize {
+			return 0, errors.WithStack(ErrMessageTooLarge)
+		}
 		return s.sendReliable(Data, data)
 	case Unreliable:
+		if len(data) > UnreliableMaxMessageSize {
+			return 0, errors.WithStack(ErrMessageTooLarge)
+		}
 		s.sendUnReliable(data)
 		return 0, nil
 	default:
@@ -351,33 +714,79 @@ func (s *Session) Send(data []byte, channel Channel) (int, error) {
 	}
 }
 
+// sendReliable blocks while kcp's send window is full
 func (s *Session) sendReliable(opcode Kcp2kOpcode, data []byte) (int, error) {
-	return s.kcpSess.Write(append([]byte{byte(opcode)}, data...))
+	packet := append([]byte{byte(opcode)}, data...)
+	for {
+		n, err := s.kcpSession().Write(packet)
+		if err != nil {
+			if derr := s.deadError(); derr != nil {
+				return 0, derr
+			}
+			// the deadline of a concurrent writeNoWait, not ours
+			if isTimeout(err) {
+				continue
+			}
+			return n, err
+		}
+		if opcode == Data {
+			s.sentMessages.Add(1)
+		}
+		return n, nil
+	}
 }
 
-func (s *Session) sendUnReliable(data []byte) {
-	bts := xmitBuf.Get().([]byte)[:len(data)+headerSize]
-	bts[0] = byte(Unreliable)
-	copy(bts[1:], s.cookie)
-	copy(bts[headerSize:], data)
+// writeReliable is sendReliable for callers holding s.mu, on a kcp session whose window isn't full
+func writeReliable(kcpSess *kcp.UDPSession, opcode Kcp2kOpcode, data []byte) (int, error) {
+	return kcpSess.Write(append([]byte{byte(opcode)}, data...))
+}
 
-	var msg ipv4.Message
-	msg.Buffers = [][]byte{bts}
-	msg.Addr = s.remote
-	s.chTxQueue <- msg
-	return
+// writeNoWait writes a packet unless kcp's send window is full, it never blocks.
+// It must not be called with s.mu held
+func (s *Session) writeNoWait(kcpSess *kcp.UDPSession, packet []byte) (int, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	// kcp-go's Write only checks a deadline in the past once the window is full
+	kcpSess.SetWriteDeadline(time.Now())
+	defer kcpSess.SetWriteDeadline(time.Time{})
+	n, err := kcpSess.Write(packet)
+	if err != nil {
+		if isTimeout(err) {
+			return 0, errors.WithStack(ErrWindowFull)
+		}
+		return n, err
+	}
+	if Kcp2kOpcode(packet[0]) == Data {
+		s.sentMessages.Add(1)
+	}
+	return n, nil
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func (s *Session) sendUnReliable(data []byte) {
+	s.enqueue(s.newDatagram(Unreliable, data))
 }
 
 // kcp出口
 func (s *Session) KCPOutput(data []byte) {
-	var msg ipv4.Message
+	s.enqueue(s.newDatagram(Reliable, data))
+}
+
+func (s *Session) newDatagram(channel Channel, data []byte) ipv4.Message {
+	e := s.endpoint.Load()
 	bts := xmitBuf.Get().([]byte)[:len(data)+headerSize]
-	bts[0] = byte(Reliable)
-	copy(bts[1:], s.cookie)
+	putHeader(bts, channel, e.cookie)
 	copy(bts[headerSize:], data)
+
+	var msg ipv4.Message
 	msg.Buffers = [][]byte{bts}
-	msg.Addr = s.remote
-	s.chTxQueue <- msg
+	msg.Addr = e.addr
+	return msg
 }
 
 func (s *Session) notifyReadError(err error) {
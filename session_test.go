@@ -0,0 +1,185 @@
+package kcp2k
+
+import (
+	"github.com/0990/kcp2k-go/pkg/leakcheck"
+	"github.com/0990/kcp2k-go/pkg/netsim"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hammer reads and sends on s from three goroutines until it dies
+func hammer(wg *sync.WaitGroup, s *Session) {
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, ReliableMaxMessageSize)
+		for {
+			if _, _, err := s.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	for _, channel := range []Channel{Reliable, Unreliable} {
+		go func(channel Channel) {
+			defer wg.Done()
+			for {
+				if _, err := s.Send([]byte("stress"), channel); err != nil {
+					return
+				}
+			}
+		}(channel)
+	}
+}
+
+// TestConcurrentSendReadClose is meant for -race: sessions are read from, sent on and closed from
+// several goroutines at once while the listener closes underneath them and more clients handshake
+func TestConcurrentSendReadClose(t *testing.T) {
+	snap := leakcheck.Take()
+	n := netsim.New(1)
+	l, lconn := serve(t, n, WithLogger(discardLogger), WithResumption(time.Minute))
+	defer lconn.Close()
+
+	// every pair handshakes before the hammering starts, it would crowd out later handshakes
+	var sessions, clients []*Session
+	for i := 0; i < 8; i++ {
+		c, cconn := dial(t, n, l, WithLogger(discardLogger), WithResumption(1))
+		defer cconn.Close()
+		clients = append(clients, c)
+
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, c, s)
+	}
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		hammer(&wg, s)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// every client closed twice at once, half the server sessions too, and the listener
+	var closers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		conn, err := n.Listen("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		closers.Add(1)
+		go func() {
+			defer closers.Done()
+			if c, err := DialConn(conn, l.Addr(), WithLogger(discardLogger), WithResumption(1),
+				WithHandshakeTimeout(200*time.Millisecond)); err == nil {
+				c.Close()
+			}
+		}()
+	}
+	for _, c := range clients {
+		closers.Add(2)
+		for i := 0; i < 2; i++ {
+			go func(c *Session) {
+				defer closers.Done()
+				c.Close()
+			}(c)
+		}
+	}
+	for i, s := range l.Sessions() {
+		if i%2 == 0 {
+			closers.Add(1)
+			go func(s *Session) {
+				defer closers.Done()
+				s.Close()
+			}(s)
+		}
+	}
+	closers.Add(1)
+	go func() {
+		defer closers.Done()
+		l.Close()
+	}()
+	closers.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read or Send still blocked after Close")
+	}
+	if n := l.SessionCount(); n != 0 {
+		t.Fatalf("%d sessions after Close", n)
+	}
+	if err := snap.Check(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// closedSession is a server-side session without a transport that received msgs and then Disconnect
+func closedSession(t *testing.T, msgs ...string) *Session {
+	a, b := netsim.Pipe(1, netsim.Link{}, netsim.Link{})
+	t.Cleanup(func() { a.Close(); b.Close() })
+	s := bareSession(a, b)
+	t.Cleanup(s.Close)
+
+	s.onRawInputUnreliable([]byte("unreliable"))
+	for _, msg := range msgs {
+		if err := s.handleKCPRawData(append([]byte{byte(Data)}, msg...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.handleKCPRawData([]byte{byte(Disconnect)})
+	return s
+}
+
+func isPeerDisconnect(err error) bool {
+	var derr *DisconnectError
+	return errors.As(err, &derr) && derr.Code == ConnectionClosed
+}
+
+func TestReadDeliversQueuedMessagesBeforeCloseError(t *testing.T) {
+	s := closedSession(t, "a", "b", "c")
+
+	var reliable []string
+	var unreliable int
+	buf := make([]byte, ReliableMaxMessageSize)
+	for i := 0; i < 4; i++ {
+		n, channel, err := s.Read(buf)
+		if err != nil {
+			t.Fatalf("Read %d returned %v before the queued messages", i, err)
+		}
+		if channel == Unreliable {
+			unreliable++
+		} else {
+			reliable = append(reliable, string(buf[:n]))
+		}
+	}
+	if unreliable != 1 || strings.Join(reliable, "") != "abc" {
+		t.Fatalf("read %q and %d unreliable, want abc in order and 1", reliable, unreliable)
+	}
+	if _, _, err := s.Read(buf); !isPeerDisconnect(err) {
+		t.Fatalf("Read returned %v once drained, want the DisconnectError", err)
+	}
+}
+
+func TestCloseErrorWinsOverSocketError(t *testing.T) {
+	s := closedSession(t)
+	s.notifyReadError(errors.New("socket read failed"))
+	s.Read(make([]byte, ReliableMaxMessageSize)) // the unreliable message
+
+	// Read and Send pick among ready channels at random, ask often enough to catch a wrong pick
+	for i := 0; i < 100; i++ {
+		if _, _, err := s.Read(make([]byte, ReliableMaxMessageSize)); !isPeerDisconnect(err) {
+			t.Fatalf("Read returned %v, want the DisconnectError", err)
+		}
+		if _, err := s.Send([]byte("x"), Reliable); !isPeerDisconnect(err) {
+			t.Fatalf("Send returned %v, want the DisconnectError", err)
+		}
+	}
+}